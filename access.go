@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// isCreator reports whether client opened room, or is an admin, and so may
+// change its modes. Names are freed when their users leave, so the creator must
+// have proved its name. The caller must hold s.mu.
+func (s *Server) isCreator(client *Client, room string) bool {
+	if s.isAdmin(client) {
+		return true
+	}
+	rs, ok := s.roomInfo[room]
+	return ok && rs.creator != "" && rs.creator == client.userName && provedName(client)
+}
+
+// accessRefusal explains why client may not join room with key because the
+// room is keyed or invite-only, or returns "" if it may. The room's creator and
+// whoever it invited need no key. The caller must hold s.mu.
+func (s *Server) accessRefusal(client *Client, room, key string) string {
+	rs, ok := s.roomInfo[room]
+	if !ok || s.isCreator(client, room) || rs.invited[client.userName] {
+		return ""
+	}
+	switch {
+	case rs.inviteOnly:
+		return fmt.Sprintf("%s is invite-only. Ask one of its operators to /invite you.\n", room)
+	case rs.key != "" && key == "":
+		return fmt.Sprintf("%s needs a key. Use /join %s <key>.\n", room, room)
+	case rs.key != "" && key != rs.key:
+		return fmt.Sprintf("Wrong key for %s.\n", room)
+	}
+	return ""
+}
+
+// readRefusal explains why client may not see the history or members of room,
+// or returns "" if it may: the same rules as joining it, except that members can
+// always see their own room. The caller must hold s.mu.
+func (s *Server) readRefusal(client *Client, room string) string {
+	if client.room == room {
+		return ""
+	}
+	if refusal := s.joinRefusal(client, room); refusal != "" {
+		return refusal
+	}
+	return s.accessRefusal(client, room, "")
+}
+
+// setMode handles "/mode <+k key|-k|+i|-i>", which only the creator of a room may use.
+// +k locks the room with a key that /join must give; +i lets in only invited users.
+func (s *Server) setMode(client *Client, args []string) {
+	mode := args[0]
+	switch {
+	case mode == "+k" && len(args) < 2:
+		s.sendError(client, "Give the key to lock the room with: /mode +k <key>\n")
+		return
+	case mode == "+k":
+	case mode == "-k", mode == "+i", mode == "-i":
+		if len(args) > 1 {
+			s.sendError(client, fmt.Sprintf("%s takes no argument.\n", mode))
+			return
+		}
+	default:
+		s.sendError(client, fmt.Sprintf("Unknown mode %q. Use +k <key>, -k, +i or -i.\n", mode))
+		return
+	}
+
+	s.mu.Lock()
+	room, actor := client.room, client.userName
+	if room == "" {
+		s.mu.Unlock()
+		s.sendError(client, "You are not in a room. Use /join [room-name] first.\n")
+		return
+	}
+	if !s.isCreator(client, room) {
+		refusal := fmt.Sprintf("Only the creator of %s can change its modes.\n", room)
+		if rs, ok := s.roomInfo[room]; ok && rs.creator == actor {
+			refusal = fmt.Sprintf("Register your name with /register before changing the modes of %s, so nobody else can use it to take the room over.\n", room)
+		}
+		s.mu.Unlock()
+		s.sendError(client, refusal)
+		return
+	}
+	rs := s.roomState(room)
+	var message string
+	switch mode {
+	case "+k":
+		rs.key = args[1]
+		message = fmt.Sprintf("%s locked %s with a key", actor, room)
+	case "-k":
+		rs.key = ""
+		message = fmt.Sprintf("%s removed the key from %s", actor, room)
+	case "+i":
+		rs.inviteOnly = true
+		// whoever is already in the room can come back
+		for _, c := range s.rooms[room] {
+			rs.invited[c.userName] = true
+		}
+		message = fmt.Sprintf("%s made %s invite-only", actor, room)
+	case "-i":
+		rs.inviteOnly = false
+		message = fmt.Sprintf("%s opened %s to everyone", actor, room)
+	}
+	s.mu.Unlock()
+
+	s.saveModes()
+	s.notifyRoom(room, []byte(message), Event{Type: EventMode, Room: room, From: actor, Text: mode})
+}
+
+// invite handles "/invite <user>", letting an online user into the client's
+// room whatever its modes. The room's creator and operators may invite.
+func (s *Server) invite(client *Client, args []string) {
+	userName := args[0]
+	target := s.findClient(userName)
+
+	s.mu.Lock()
+	room, actor := client.room, client.userName
+	allowed := room != "" && (s.isCreator(client, room) || s.isOperator(client, room))
+	if allowed && target != nil {
+		s.roomState(room).invited[userName] = true
+	}
+	s.mu.Unlock()
+
+	switch {
+	case room == "":
+		s.sendError(client, "You are not in a room. Use /join [room-name] first.\n")
+		return
+	case !allowed:
+		s.sendError(client, fmt.Sprintf("Only operators of %s can invite users.\n", room))
+		return
+	case target == nil:
+		s.sendError(client, fmt.Sprintf("%s is not online.\n", userName))
+		return
+	}
+	s.saveModes()
+
+	ev := Event{Type: EventInvite, Room: room, From: actor, To: userName}
+	s.notifyRoom(room, []byte(fmt.Sprintf("%s invited %s to %s", actor, userName, room)), ev)
+	if target != client {
+		s.sendEvent(target, []byte(fmt.Sprintf("\r%s invited you to %s. Use /join %s to accept.\n", actor, room, room)), ev)
+	}
+}
+
+// forgetInvitations drops the invitations of a user who is leaving the server,
+// unless their name is registered to them: anyone could take it once it is free.
+// The caller must hold s.mu for writing.
+func (s *Server) forgetInvitations(client *Client) {
+	if client.account == client.userName {
+		return
+	}
+	for _, rs := range s.roomInfo {
+		delete(rs.invited, client.userName)
+	}
+}
+
+// roomModes returns the modes of every private room, as a RoomModeStore keeps
+// them. The caller must hold s.mu.
+func (s *Server) roomModes() map[string]RoomModes {
+	modes := make(map[string]RoomModes)
+	for room, rs := range s.roomInfo {
+		if rs.key == "" && !rs.inviteOnly && len(rs.invited) == 0 {
+			continue
+		}
+		var invited []string
+		for name := range rs.invited {
+			invited = append(invited, name)
+		}
+		slices.Sort(invited)
+		modes[room] = RoomModes{Creator: rs.creator, Key: rs.key, InviteOnly: rs.inviteOnly, Invited: invited}
+	}
+	return modes
+}
+
+// saveModes saves the modes of private rooms to the history store if it keeps
+// them, so the rooms stay private after a restart. It writes only when they
+// changed since the last save. The caller must not hold s.mu.
+func (s *Server) saveModes() {
+	s.modesMu.Lock()
+	defer s.modesMu.Unlock()
+	s.mu.RLock()
+	store, ok := s.store.(RoomModeStore)
+	modes := s.roomModes()
+	s.mu.RUnlock()
+	if !ok || maps.EqualFunc(modes, s.savedModes, sameModes) {
+		return
+	}
+	if err := store.SaveModes(modes); err != nil {
+		fmt.Println("Error saving room modes:", err)
+		return
+	}
+	s.savedModes = modes
+}
+
+// sameModes reports whether a and b are the same modes.
+func sameModes(a, b RoomModes) bool {
+	return a.Creator == b.Creator && a.Key == b.Key && a.InviteOnly == b.InviteOnly && slices.Equal(a.Invited, b.Invited)
+}
+
+// restoreModes gives rooms the modes saved before a restart. Invitations are
+// only kept for registered names, since anyone may have taken the others.
+// The caller must hold s.mu for writing.
+func (s *Server) restoreModes(modes map[string]RoomModes) {
+	for room, m := range modes {
+		rs := s.roomState(room)
+		rs.creator, rs.key, rs.inviteOnly = m.Creator, m.Key, m.InviteOnly
+		for _, name := range m.Invited {
+			if s.accounts != nil && s.accounts.registered(name) {
+				rs.invited[name] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newAccessTestServer starts a server whose accounts live in a temporary file,
+// since only registered users may lock rooms.
+func newAccessTestServer(t *testing.T) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	t.Cleanup(func() { close(s.msgChan) })
+	return s
+}
+
+func TestServer_privateRooms(t *testing.T) {
+	s := newAccessTestServer(t)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	carol := connectTestClient(t, s, &wg, "carol")
+	carol.waitFor(t, "Welcome, carol!")
+
+	alice.send("/join incident")
+	alice.waitFor(t, "You have joined: incident")
+	alice.send("/mode +i")
+	alice.waitFor(t, "Register your name with /register before changing the modes of incident")
+	alice.send("/register hunter22")
+	alice.waitFor(t, "alice is now registered.")
+	alice.send("/mode +x")
+	alice.waitFor(t, `Unknown mode "+x". Use +k <key>, -k, +i or -i.`)
+	alice.send("/mode +k")
+	alice.waitFor(t, "Give the key to lock the room with: /mode +k <key>")
+	alice.send("/mode +k hunter2")
+	alice.waitFor(t, "alice locked incident with a key")
+
+	bob.send("/join incident")
+	bob.waitFor(t, "incident needs a key. Use /join incident <key>.")
+	bob.send("/join incident letmein")
+	bob.waitFor(t, "Wrong key for incident.")
+	bob.send("/join incident hunter2")
+	bob.waitFor(t, "You have joined: incident")
+
+	// only the creator changes modes, even once others are operators
+	alice.send("/op bob")
+	bob.waitFor(t, "alice made bob an operator of incident")
+	bob.send("/mode -k")
+	bob.waitFor(t, "Only the creator of incident can change its modes.")
+
+	alice.send("/mode +i")
+	bob.waitFor(t, "alice made incident invite-only")
+	carol.send("/join incident hunter2")
+	carol.waitFor(t, "incident is invite-only. Ask one of its operators to /invite you.")
+	carol.send("/invite alice")
+	carol.waitFor(t, "Only operators of room1_:0 can invite users.")
+
+	// nor can outsiders read the room from outside
+	alice.send("the password is swordfish")
+	bob.waitFor(t, "[alice]:the password is swordfish")
+	carol.send("/search swordfish room:incident")
+	carol.waitFor(t, "incident is invite-only. Ask one of its operators to /invite you.\n")
+	carol.send("/rooms incident")
+	carol.waitFor(t, "incident is invite-only. Ask one of its operators to /invite you.\nincident is invite-only.")
+	carol.mu.Lock()
+	seen := strings.Contains(carol.out.String(), "bob has joined the room!")
+	carol.mu.Unlock()
+	if seen {
+		t.Error("carol was told who joined incident from outside it")
+	}
+	carol.send("/rooms")
+	carol.waitFor(t, "available rooms:\n  room1_:0 (1 user)\n")
+	carol.send("/search swordfish")
+	carol.waitFor(t, "No messages found.")
+	carol.send("/leave")
+	carol.waitFor(t, "You have left")
+	carol.send("/join room1_:0")
+	carol.waitFor(t, "You have joined: room1_:0")
+
+	bob.send("/invite dave")
+	bob.waitFor(t, "dave is not online.")
+	bob.send("/invite carol")
+	carol.waitFor(t, "bob invited you to incident. Use /join incident to accept.")
+	alice.waitFor(t, "bob invited carol to incident")
+	carol.send("/join incident")
+	carol.waitFor(t, "You have joined: incident")
+
+	// members when the room went invite-only, and whoever was invited, can come back
+	bob.send("/leave")
+	bob.waitFor(t, "You have left")
+	bob.send("/join incident")
+	bob.waitFor(t, "You have joined: incident")
+
+	alice.send("/mode -i")
+	carol.waitFor(t, "alice opened incident to everyone")
+	alice.send("/mode -k")
+	carol.waitFor(t, "alice removed the key from incident")
+
+	for _, tc := range []*testClient{alice, bob, carol} {
+		tc.send("/quit")
+	}
+	wg.Wait()
+}
+
+func TestServer_privateRoomOutlivesMembers(t *testing.T) {
+	s := newAccessTestServer(t)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/register hunter22")
+	alice.waitFor(t, "alice is now registered.")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+
+	alice.send("/join vault")
+	alice.waitFor(t, "You have joined: vault")
+	alice.send("/mode +k s3cret")
+	alice.waitFor(t, "alice locked vault with a key")
+	alice.send("/leave")
+	alice.waitFor(t, "You have left")
+
+	// nobody takes over an empty keyed room by opening it again
+	bob.send("/join vault")
+	bob.waitFor(t, "vault needs a key. Use /join vault <key>.")
+
+	// the room belongs to the registered name, not to whatever name alice picks next
+	alice.send("/name alicia")
+	alice.waitFor(t, "You are now alicia")
+	alice.send("/join vault")
+	alice.waitFor(t, "vault needs a key. Use /join vault <key>.")
+	alice.send("/name alice")
+	alice.waitFor(t, "You are now alice")
+	alice.send("/join vault")
+	alice.send("/rooms vault")
+	alice.waitFor(t, "Members in vault: alice")
+
+	alice.send("/quit")
+	bob.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_privateRoomRightsLeaveWithTheirName(t *testing.T) {
+	s := newAccessTestServer(t)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/register hunter22")
+	alice.waitFor(t, "alice is now registered.")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+
+	alice.send("/join incident")
+	alice.waitFor(t, "You have joined: incident")
+	alice.send("/mode +i")
+	alice.waitFor(t, "alice made incident invite-only")
+	alice.send("/invite bob")
+	bob.waitFor(t, "alice invited you to incident.")
+
+	// bob never registered, so his invitation goes when he does
+	bob.send("/quit")
+	mallory := connectTestClient(t, s, &wg, "bob")
+	mallory.waitFor(t, "Welcome, bob!")
+	mallory.send("/join incident")
+	mallory.waitFor(t, "incident is invite-only.")
+
+	// a name that proves nothing does not make its holder the creator
+	mallory.send("/join vault")
+	mallory.waitFor(t, "You have joined: vault")
+	mallory.send("/mode +k mine")
+	mallory.waitFor(t, "Register your name with /register before changing the modes of vault")
+
+	alice.send("/quit")
+	mallory.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_privateRoomSurvivesRestart(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	cfg.HistoryDir = t.TempDir()
+
+	first, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	go first.dispatchMessages()
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, first, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/register hunter22")
+	alice.waitFor(t, "alice is now registered.")
+	alice.send("/join vault")
+	alice.waitFor(t, "You have joined: vault")
+	alice.send("the safe code is 4711")
+	alice.waitFor(t, "[alice]:the safe code is 4711")
+	alice.send("/mode +k s3cret")
+	alice.waitFor(t, "alice locked vault with a key")
+	alice.send("/quit")
+	wg.Wait()
+	close(first.msgChan)
+	first.closeHistory()
+
+	second, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	defer second.closeHistory()
+	go second.dispatchMessages()
+	defer close(second.msgChan)
+
+	bob := connectTestClient(t, second, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	bob.send("/join vault")
+	bob.waitFor(t, "vault needs a key. Use /join vault <key>.")
+	bob.send("/search 4711 room:vault")
+	bob.waitFor(t, "vault needs a key. Use /join vault <key>.\nvault needs a key.")
+	bob.send("/join vault s3cret")
+	bob.waitFor(t, "the safe code is 4711")
+	bob.send("/quit")
+	wg.Wait()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters for password hashing.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+
+	minPasswordLen = 6
+)
+
+// account is a registered nickname as stored in the accounts file.
+type account struct {
+	Salt string `json:"salt"` // base64 random salt
+	Hash string `json:"hash"` // base64 scrypt hash of the password and salt
+}
+
+// accountStore keeps registered nicknames in a JSON file.
+type accountStore struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]account
+}
+
+var errAlreadyRegistered = errors.New("name already registered")
+
+// loadAccounts reads the accounts file at path. A missing file means no accounts yet.
+func loadAccounts(path string) (*accountStore, error) {
+	as := &accountStore{path: path, accounts: make(map[string]account)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return as, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &as.accounts); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return as, nil
+}
+
+// registered reports whether userName belongs to an account.
+func (as *accountStore) registered(userName string) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	_, ok := as.accounts[userName]
+	return ok
+}
+
+// register claims userName with password and saves the accounts file.
+func (as *accountStore) register(userName, password string) error {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if _, ok := as.accounts[userName]; ok {
+		return errAlreadyRegistered
+	}
+	as.accounts[userName] = account{
+		Salt: base64.StdEncoding.EncodeToString(salt),
+		Hash: base64.StdEncoding.EncodeToString(hash),
+	}
+	if err := as.save(); err != nil {
+		delete(as.accounts, userName)
+		return err
+	}
+	return nil
+}
+
+// verify reports whether password is correct for the account userName.
+func (as *accountStore) verify(userName, password string) bool {
+	as.mu.Lock()
+	acc, ok := as.accounts[userName]
+	as.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(acc.Salt)
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(acc.Hash)
+	if err != nil {
+		return false
+	}
+	got, err := hashPassword(password, salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// save writes the accounts file atomically. The caller must hold as.mu.
+func (as *accountStore) save() error {
+	data, err := json.MarshalIndent(as.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(as.path), ".accounts-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), as.path)
+}
+
+// hashPassword derives the stored hash of password with salt.
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+}
+
+// authenticate asks for the password of a registered name, allowing a few attempts.
+// It reports whether the client proved they own the name.
+func (s *Server) authenticate(client *Client, userName string) bool {
+	for attempt := 0; attempt < 3; attempt++ {
+		s.sendEvent(client, []byte("[ENTER PASSWORD]: "), Event{Type: EventPrompt, Field: "password"})
+		password, err := s.readLine(client)
+		if err != nil {
+			return false
+		}
+		if s.accounts.verify(userName, strings.TrimSpace(password)) {
+			return true
+		}
+		s.sendError(client, "Wrong password.\n")
+	}
+	return false
+}
+
+// registerName handles "/register <password>", claiming the client's current name.
+func (s *Server) registerName(client *Client, password string) {
+	if s.accounts == nil {
+		s.sendError(client, "Registration is disabled on this server.\n")
+		return
+	}
+	if len(password) < minPasswordLen {
+		s.sendError(client, fmt.Sprintf("Passwords must be at least %d characters.\n", minPasswordLen))
+		return
+	}
+
+	s.mu.RLock()
+	userName := client.userName
+	s.mu.RUnlock()
+
+	switch err := s.accounts.register(userName, password); err {
+	case nil:
+		s.mu.Lock()
+		client.account = userName
+		s.mu.Unlock()
+		s.mailbox.remember(userName)
+		s.send(client, []byte(fmt.Sprintf("%s is now registered. You will be asked for this password when you log in.\n", userName)))
+	case errAlreadyRegistered:
+		s.sendError(client, fmt.Sprintf("%s is already registered.\n", userName))
+	default:
+		fmt.Println("Error saving accounts:", err)
+		s.sendError(client, "Could not register right now, try again later.\n")
+	}
+}
+
+// nameTakenByAccount reports whether userName is registered to an account the client has not logged in to.
+func (s *Server) nameTakenByAccount(client *Client, userName string) bool {
+	if s.accounts == nil || !s.accounts.registered(userName) {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return client.account != userName
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAccountStore_registerAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	as, err := loadAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := as.register("alice", "hunter22"); err != nil {
+		t.Fatalf("register() error = %v", err)
+	}
+	if err := as.register("alice", "other-pass"); err != errAlreadyRegistered {
+		t.Errorf("second register() error = %v, want %v", err, errAlreadyRegistered)
+	}
+
+	reloaded, err := loadAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		userName string
+		password string
+		want     bool
+	}{
+		{name: "Correct password", userName: "alice", password: "hunter22", want: true},
+		{name: "Wrong password", userName: "alice", password: "hunter23", want: false},
+		{name: "Unregistered name", userName: "bob", password: "hunter22", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reloaded.verify(tt.userName, tt.password); got != tt.want {
+				t.Errorf("verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_registeredNames(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/register hunter22")
+	alice.waitFor(t, "alice is now registered.")
+	alice.send("/name alice2")
+	alice.waitFor(t, "You are now alice2")
+
+	mallory := connectTestClient(t, s, &wg, "mallory")
+	mallory.waitFor(t, "Welcome, mallory!")
+	mallory.send("/name alice")
+	mallory.waitFor(t, "alice is registered to someone else.")
+
+	impostor := connectTestClient(t, s, &wg, "alice")
+	impostor.waitFor(t, "[ENTER PASSWORD]: ")
+	impostor.send("guess1")
+	impostor.send("guess2")
+	impostor.send("guess3")
+	impostor.waitFor(t, "Authentication failed. Disconnecting...")
+
+	// the owner may take the registered name back
+	alice.send("/name alice")
+	alice.waitFor(t, "You are now alice")
+
+	alice.send("/quit")
+	mallory.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_passwordPromptHoldsNoName(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/register hunter22")
+	alice.waitFor(t, "alice is now registered.")
+	alice.send("/quit")
+
+	// someone sits at the password prompt without answering
+	lurker := connectTestClient(t, s, &wg, "alice")
+	lurker.waitFor(t, "[ENTER PASSWORD]: ")
+
+	alice = connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "[ENTER PASSWORD]: ")
+	alice.send("hunter22")
+	alice.waitFor(t, "Welcome, alice!")
+
+	// and gets the name only if nobody holds it by the time they answer
+	lurker.send("hunter22")
+	lurker.waitFor(t, "alice is already in the chat. Please choose another name.")
+
+	lurker.conn.Close()
+	alice.send("/quit")
+	wg.Wait()
+}
@@ -2,43 +2,60 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 const reconnectAttempts = 3
 
 type Client struct {
-	conn     net.Conn
-	userName string
-	input    chan string
+	conn       net.Conn
+	userName   string
+	input      chan string
+	structured bool // speak the JSON lines protocol instead of text
+	certified  bool // logged in by client certificate, so there is no name prompt
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]string // JSON requests awaiting an answer, keyed by id
 }
 
-// NewClient creates a new client instance and connects it to the server
-func NewClient(serverAdr string) (*Client, error) {
-	conn, err := connectToServer(serverAdr)
+// NewClient creates a new client instance and connects it to the server.
+// The connection uses TLS when tlsConfig is not nil.
+func NewClient(serverAdr string, tlsConfig *tls.Config, structured bool) (*Client, error) {
+	conn, err := connectToServer(serverAdr, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	client := &Client{
-		conn:  conn,
-		input: make(chan string),
+		conn:       conn,
+		input:      make(chan string),
+		structured: structured,
+		certified:  tlsConfig != nil && len(tlsConfig.Certificates) > 0,
+		pending:    make(map[string]string),
 	}
 
 	return client, nil
 }
 
 // connectToServer tries to establish a connection to the server with retry logic
-func connectToServer(serverAdr string) (net.Conn, error) {
+func connectToServer(serverAdr string, tlsConfig *tls.Config) (net.Conn, error) {
 	var conn net.Conn
 	var err error
 
 	for i := 1; i <= reconnectAttempts; i++ {
-		conn, err = net.Dial("tcp", serverAdr)
+		if tlsConfig != nil {
+			conn, err = tls.Dial("tcp", serverAdr, tlsConfig)
+		} else {
+			conn, err = net.Dial("tcp", serverAdr)
+		}
 		if err == nil {
 			return conn, nil
 		}
@@ -53,8 +70,16 @@ func (c *Client) Start() {
 	defer c.conn.Close()
 
 	reader := bufio.NewReader(c.conn)
-	if err := c.readServerPrompt(reader); err != nil {
-		return
+	switch {
+	case c.structured:
+		// prompts arrive as events, so the name is read like any other input
+		c.sendMessage(jsonHandshake)
+	case c.certified:
+		// the server names us after our certificate without asking
+	default:
+		if err := c.readServerPrompt(reader); err != nil {
+			return
+		}
 	}
 
 	go c.handleUserInput()
@@ -111,6 +136,12 @@ func (c *Client) listenForServerMessages(reader *bufio.Reader) {
 			os.Exit(0)
 		}
 
+		if c.structured {
+			if msg, ok := c.renderEvent(strings.TrimSpace(msg)); ok {
+				fmt.Print(msg)
+			}
+			continue
+		}
 		fmt.Print(msg)
 	}
 }
@@ -138,19 +169,36 @@ func (c *Client) sendMessage(msg string) {
 // mainLoop continuously processes user input and sends messages to the server
 func (c *Client) mainLoop() {
 	for input := range c.input {
+		if c.structured {
+			input = c.encodeRequest(input)
+		}
 		c.sendMessage(input)
 	}
 	fmt.Println("Input channel closed. Exiting...")
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: go run . <hostIp:port>")
+	structured := flag.Bool("json", false, "use the JSON lines protocol instead of plain text")
+	useTLS := flag.Bool("tls", false, "connect over TLS")
+	caFile := flag.String("ca", "", "PEM file of CAs to trust for -tls instead of the system ones")
+	certFile := flag.String("cert", "", "client certificate (PEM) to log in with over -tls")
+	keyFile := flag.String("key", "", "private key (PEM) for -cert")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: go run . [-json] [-tls [-ca file] [-cert file -key file]] <hostIp:port>")
 		return
 	}
 
-	serverAdr := os.Args[1]
-	client, err := NewClient(serverAdr)
+	serverAdr := flag.Arg(0)
+	var tlsConfig *tls.Config
+	if *useTLS || *caFile != "" || *certFile != "" {
+		var err error
+		if tlsConfig, err = newTLSConfig(serverAdr, *caFile, *certFile, *keyFile); err != nil {
+			fmt.Println("TLS setup failed:", err)
+			return
+		}
+	}
+	client, err := NewClient(serverAdr, tlsConfig, *structured)
 	if err != nil {
 		fmt.Printf("Could not connect to Server after attempting %d\n %v", reconnectAttempts, err)
 		return
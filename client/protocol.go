@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonHandshake asks the server to speak the JSON lines protocol.
+const jsonHandshake = "HELLO json"
+
+// event is a line sent by the server in JSON mode.
+type event struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id"`
+	ReplyTo string    `json:"reply_to"`
+	Room    string    `json:"room"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Text    string    `json:"text"`
+	Field   string    `json:"field"`
+	History bool      `json:"history"`
+	Time    time.Time `json:"time"`
+}
+
+// request is a line sent to the server in JSON mode.
+type request struct {
+	ID   string   `json:"id"`
+	Cmd  string   `json:"cmd,omitempty"`
+	Args []string `json:"args,omitempty"`
+	Text string   `json:"text,omitempty"`
+}
+
+// encodeRequest turns what the user typed into a JSON request, remembering it
+// until the server answers so errors can say which input they refer to.
+func (c *Client) encodeRequest(input string) string {
+	c.mu.Lock()
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	c.pending[id] = input
+	c.mu.Unlock()
+
+	req := request{ID: id, Text: input}
+	if strings.HasPrefix(input, "/") {
+		fields := strings.Fields(input)
+		req = request{ID: id, Cmd: strings.TrimPrefix(fields[0], "/"), Args: fields[1:]}
+	}
+	line, _ := json.Marshal(req)
+	return string(line)
+}
+
+// renderEvent formats a server event for the terminal. It returns false for
+// events that have nothing to show.
+func (c *Client) renderEvent(line string) (string, bool) {
+	var ev event
+	if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		return line, true
+	}
+	timestamp := ev.Time.Local().Format("2006-01-02 15:04:05")
+
+	switch ev.Type {
+	case "prompt":
+		return fmt.Sprintf("[ENTER YOUR %s]: ", strings.ToUpper(ev.Field)), true
+	case "message":
+		return fmt.Sprintf("[%s][%s]:%s\n", timestamp, ev.From, ev.Text), true
+	case "join":
+		return fmt.Sprintf("%s has joined %s\n", ev.From, ev.Room), true
+	case "leave":
+		return fmt.Sprintf("%s has left %s\n", ev.From, ev.Room), true
+	case "rename":
+		return fmt.Sprintf("%s is now known as %s\n", ev.From, ev.To), true
+	case "dm":
+		return fmt.Sprintf("[%s][DM %s -> %s]: %s\n", timestamp, ev.From, ev.To, ev.Text), true
+	case "notice":
+		return fmt.Sprintf("[SERVER]: %s\n", ev.Text), true
+	case "op":
+		if ev.From == "" {
+			return fmt.Sprintf("You are an operator of %s\n", ev.Room), true
+		}
+		return fmt.Sprintf("%s made %s an operator of %s\n", ev.From, ev.To, ev.Room), true
+	case "deop":
+		return fmt.Sprintf("%s removed %s as an operator of %s\n", ev.From, ev.To, ev.Room), true
+	case "kick":
+		if ev.Text != "" {
+			return fmt.Sprintf("%s was kicked from %s by %s: %s\n", ev.To, ev.Room, ev.From, ev.Text), true
+		}
+		return fmt.Sprintf("%s was kicked from %s by %s\n", ev.To, ev.Room, ev.From), true
+	case "ban", "unban":
+		return fmt.Sprintf("%s %sned %s in %s\n", ev.From, ev.Type, ev.To, ev.Room), true
+	case "mute", "unmute":
+		if ev.Text != "" {
+			return fmt.Sprintf("%s %sd %s for %s\n", ev.From, ev.Type, ev.To, ev.Text), true
+		}
+		return fmt.Sprintf("%s %sd %s\n", ev.From, ev.Type, ev.To), true
+	case "topic":
+		return fmt.Sprintf("%s set the topic of %s to: %s\n", ev.From, ev.Room, ev.Text), true
+	case "mode":
+		return fmt.Sprintf("%s set mode %s on %s\n", ev.From, ev.Text, ev.Room), true
+	case "invite":
+		return fmt.Sprintf("%s invited %s to %s\n", ev.From, ev.To, ev.Room), true
+	case "ok":
+		c.answered(ev.ReplyTo)
+		return "", false
+	case "error":
+		if input := c.answered(ev.ReplyTo); input != "" {
+			return fmt.Sprintf("Error (%s): %s\n", input, ev.Text), true
+		}
+		return fmt.Sprintf("Error: %s\n", ev.Text), true
+	default:
+		return ev.Text + "\n", true
+	}
+}
+
+// answered forgets the request id and returns what the user typed for it.
+func (c *Client) answered(id string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	input := c.pending[id]
+	delete(c.pending, id)
+	return input
+}
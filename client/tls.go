@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// newTLSConfig returns the TLS settings for connecting to serverAdr. If caFile
+// is set, the server's certificate must be signed by one of the CAs in it
+// rather than by a CA the system trusts. If certFile is set, the client
+// presents it, and the server takes the user name from it.
+func newTLSConfig(serverAdr, caFile, certFile, keyFile string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(serverAdr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
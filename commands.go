@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// command describes a slash command: how it is called and what runs it.
+type command struct {
+	name    string // including the leading slash, e.g. "/join"
+	args    string // argument synopsis for usage and /help, e.g. "<room-name>"
+	help    string // one line description for /help
+	minArgs int
+	maxArgs int  // -1 for no limit
+	rest    bool // the last argument takes the remainder of the line verbatim
+	run     func(client *Client, args []string)
+}
+
+// usage returns the usage line of the command.
+func (cmd *command) usage() string {
+	if cmd.args == "" {
+		return cmd.name
+	}
+	return cmd.name + " " + cmd.args
+}
+
+// parseArgs splits the text after the command name into arguments.
+// ok is false if the number of arguments does not fit the command.
+func (cmd *command) parseArgs(text string) (args []string, ok bool) {
+	if cmd.rest && cmd.maxArgs > 0 {
+		// split off maxArgs-1 words; whatever follows is the last argument as typed
+		text = strings.TrimSpace(text)
+		for len(args) < cmd.maxArgs-1 && text != "" {
+			word, remainder, _ := strings.Cut(text, " ")
+			args = append(args, word)
+			text = strings.TrimSpace(remainder)
+		}
+		if text != "" {
+			args = append(args, text)
+		}
+	} else {
+		args = strings.Fields(text)
+	}
+
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		return nil, false
+	}
+	return args, true
+}
+
+// addCommand registers cmd, replacing any command of the same name.
+func (s *Server) addCommand(cmd *command) {
+	s.extMu.Lock()
+	defer s.extMu.Unlock()
+	if _, exists := s.commands[cmd.name]; !exists {
+		s.commandOrder = append(s.commandOrder, cmd.name)
+	}
+	s.commands[cmd.name] = cmd
+}
+
+// dispatchCommand runs the command on line if it starts with a slash.
+// It reports whether line was a command; ordinary chat lines return false.
+func (s *Server) dispatchCommand(client *Client, line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "/") {
+		return false
+	}
+
+	name, text, _ := strings.Cut(line, " ")
+	s.extMu.RLock()
+	cmd, ok := s.commands[name]
+	s.extMu.RUnlock()
+	if !ok {
+		s.sendError(client, fmt.Sprintf("Unknown command %s. Use /help to see available commands.\n", name))
+		return true
+	}
+	args, ok := cmd.parseArgs(text)
+	if !ok {
+		s.sendError(client, fmt.Sprintf("Usage: %s\n", cmd.usage()))
+		return true
+	}
+	cmd.run(client, args)
+	return true
+}
+
+// helpText lists every registered command, or describes just one if name is given.
+func (s *Server) helpText(name string) string {
+	s.extMu.RLock()
+	defer s.extMu.RUnlock()
+	if name != "" {
+		if !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		cmd, ok := s.commands[name]
+		if !ok {
+			return fmt.Sprintf("Unknown command %s.\n", name)
+		}
+		return fmt.Sprintf("%s: %s\n", cmd.usage(), cmd.help)
+	}
+
+	var b strings.Builder
+	b.WriteString("\nAvailable commands:\n")
+	for _, name := range s.commandOrder {
+		cmd := s.commands[name]
+		fmt.Fprintf(&b, "%s: %s\n", cmd.usage(), cmd.help)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// registerBuiltins adds the commands every server understands.
+func (s *Server) registerBuiltins() {
+	s.addCommand(&command{
+		name: "/name", args: "<new-name>", help: "Change your name",
+		minArgs: 1, maxArgs: 1,
+		run: func(client *Client, args []string) { s.changeName(client, args[0]) },
+	})
+	s.addCommand(&command{
+		name: "/users", help: "See who's in the chat",
+		run: s.listUsers,
+	})
+	s.addCommand(&command{
+		name: "/help", args: "[command]", help: "Display this log of available commands",
+		maxArgs: 1,
+		run: func(client *Client, args []string) {
+			name := ""
+			if len(args) == 1 {
+				name = args[0]
+			}
+			s.send(client, []byte(s.helpText(name)))
+		},
+	})
+	s.addCommand(&command{
+		name: "/quit", help: "Leave the chat",
+		run: s.quit,
+	})
+	s.addCommand(&command{
+		name: "/join", args: "<room-name> [key]", help: "Join a specific room, giving its key if it has one",
+		minArgs: 1, maxArgs: 2,
+		run: func(client *Client, args []string) {
+			var key string
+			if len(args) > 1 {
+				key = args[1]
+			}
+			s.joinRoom(client, args[0], key)
+		},
+	})
+	s.addCommand(&command{
+		name: "/mode", args: "<+k key|-k|+i|-i>", help: "Lock a room you created with a key, or make it invite-only",
+		minArgs: 1, maxArgs: 2,
+		run: s.setMode,
+	})
+	s.addCommand(&command{
+		name: "/invite", args: "<user>", help: "Let a user into your room even if it is locked",
+		minArgs: 1, maxArgs: 1,
+		run: s.invite,
+	})
+	s.addCommand(&command{
+		name: "/leave", help: "Leave your current room",
+		run: func(client *Client, args []string) { s.leaveRoom(client) },
+	})
+	s.addCommand(&command{
+		name: "/rooms", args: "[room-name]", help: "List all available rooms, or the members of one room",
+		maxArgs: 1,
+		run: func(client *Client, args []string) {
+			if len(args) == 0 {
+				s.listRooms(client)
+				return
+			}
+			s.listRoomMembers(client, args[0])
+		},
+	})
+	s.addCommand(&command{
+		name: "/topic", args: "[text]", help: "Show or set the topic of your room",
+		maxArgs: 1, rest: true,
+		run: s.topic,
+	})
+	s.addCommand(&command{
+		name: "/history", args: "[N] [--before timestamp] [--after timestamp]", help: "Show earlier messages in your room",
+		maxArgs: -1,
+		run:     s.showHistory,
+	})
+	s.addCommand(&command{
+		name: "/search", args: "<terms> [from:user] [room:name]", help: "Find messages containing all the terms",
+		minArgs: 1, maxArgs: -1,
+		run: s.searchHistory,
+	})
+	s.addCommand(&command{
+		name: "/msg", args: "<user> <text>", help: "Send a private message",
+		minArgs: 2, maxArgs: 2, rest: true,
+		run: func(client *Client, args []string) { s.deliverDM(client, args[0], args[1]) },
+	})
+	s.addCommand(&command{
+		name: "/r", args: "<text>", help: "Reply to the last private message",
+		minArgs: 1, maxArgs: 1, rest: true,
+		run: func(client *Client, args []string) { s.replyDM(client, args[0]) },
+	})
+	s.addCommand(&command{
+		name: "/register", args: "<password>", help: "Protect your current name with a password",
+		minArgs: 1, maxArgs: 1,
+		run: func(client *Client, args []string) { s.registerName(client, args[0]) },
+	})
+	if s.config.Moderation {
+		s.registerModeration()
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCommand_parseArgs(t *testing.T) {
+	msg := &command{name: "/msg", minArgs: 2, maxArgs: 2, rest: true}
+	join := &command{name: "/join", minArgs: 1, maxArgs: 1}
+	search := &command{name: "/search", minArgs: 1, maxArgs: -1}
+	tests := []struct {
+		name   string
+		cmd    *command
+		text   string
+		want   []string
+		wantOK bool
+	}{
+		{name: "Rest keeps spacing", cmd: msg, text: " bob  hi   there ", want: []string{"bob", "hi   there"}, wantOK: true},
+		{name: "Rest missing text", cmd: msg, text: "bob", wantOK: false},
+		{name: "Exact count", cmd: join, text: "lobby", want: []string{"lobby"}, wantOK: true},
+		{name: "Missing argument", cmd: join, text: "", wantOK: false},
+		{name: "Too many arguments", cmd: join, text: "a b", wantOK: false},
+		{name: "Unlimited", cmd: search, text: "a b c from:x", want: []string{"a", "b", "c", "from:x"}, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.cmd.parseArgs(tt.text)
+			if ok != tt.wantOK || (ok && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("parseArgs(%q) = %q, %v, want %q, %v", tt.text, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestServer_helpListsEveryCommand(t *testing.T) {
+	s, _ := NewServer(":0")
+	help := s.helpText("")
+	for name, cmd := range s.commands {
+		if !strings.Contains(help, cmd.usage()+": "+cmd.help) {
+			t.Errorf("/help does not describe %s", name)
+		}
+	}
+	if got := s.helpText("join"); got != "/join <room-name> [key]: Join a specific room, giving its key if it has one\n" {
+		t.Errorf("helpText(join) = %q", got)
+	}
+}
+
+func TestServer_commandsOnlyAtLineStart(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	alice.send("check out /users page and /quit")
+	alice.waitFor(t, "[alice]:check out /users page and /quit")
+
+	alice.send("/join")
+	alice.waitFor(t, "Usage: /join <room-name>")
+	alice.send("/dance")
+	alice.waitFor(t, "Unknown command /dance. Use /help to see available commands.")
+
+	alice.send("/quit")
+	wg.Wait()
+}
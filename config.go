@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// SlowPolicy decides what happens when a client's outbound queue is full.
+type SlowPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room for the new one.
+	DropOldest SlowPolicy = iota
+	// Disconnect drops new messages and disconnects the client once its queue
+	// has stayed full for longer than Config.SlowTimeout.
+	Disconnect
+	// Block makes the sender wait until the client has room again.
+	Block
+)
+
+// String returns the command line spelling of the policy.
+func (p SlowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	case Block:
+		return "block"
+	}
+	return fmt.Sprintf("SlowPolicy(%d)", int(p))
+}
+
+// ParseSlowPolicy converts a command line value such as "drop-oldest" into a SlowPolicy.
+func ParseSlowPolicy(name string) (SlowPolicy, error) {
+	for _, p := range []SlowPolicy{DropOldest, Disconnect, Block} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow consumer policy %q (want drop-oldest, disconnect or block)", name)
+}
+
+// Config holds the tunable settings of a Server.
+type Config struct {
+	ListenAddr  string        // names the default room, and is the only listener if Listen is empty
+	Listen      []ListenSpec  // every address to accept connections on
+	HTTPAddr    string        // address of the web chat page and WebSocket gateway, empty for none
+	QueueSize   int           // outbound messages buffered per client
+	SlowPolicy  SlowPolicy    // what to do when a client's queue is full
+	SlowTimeout time.Duration // how long a full queue is tolerated under Disconnect
+
+	HistoryLimit  int           // messages kept per room, 0 for no limit
+	HistoryMaxAge time.Duration // how long messages are kept, 0 for no limit
+	HistoryDir    string        // directory history is persisted to, empty to keep it in memory only
+
+	MailboxLimit int    // direct messages queued per offline user
+	AccountsFile string // where registered names are kept, empty to disable /register
+
+	TLSCert       string // certificate file, empty to accept plain TCP
+	TLSKey        string // private key file for TLSCert
+	TLSMinVersion uint16 // oldest TLS version accepted, such as tls.VersionTLS12
+	TLSClientCA   string // CA file client certificates must be signed by, empty to not ask for them
+
+	SSHAddr           string // address to accept SSH logins on, empty for none
+	SSHHostKey        string // the server's SSH private key, generated if missing
+	SSHAuthorizedKeys string // authorized_keys style file of keys and the names they log in as
+
+	ShutdownMessage string        // what every client is told when the server shuts down
+	ShutdownTimeout time.Duration // how long clients get to receive what is queued for them on shutdown
+
+	Moderation bool     // room operators may kick, ban and mute
+	Admins     []string // names that are operators of every room, once proved by a password, certificate or key
+
+	VerifiedNames []string // names only a client certificate or SSH key may log in as, besides those of SSH keys
+}
+
+// DefaultConfig returns the settings used when none are given on the command line.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:  ":8989",
+		QueueSize:   64,
+		SlowPolicy:  DropOldest,
+		SlowTimeout: 10 * time.Second,
+
+		HistoryLimit:  100,
+		HistoryMaxAge: 24 * time.Hour,
+		HistoryDir:    "history",
+
+		MailboxLimit: 50,
+		AccountsFile: "accounts.json",
+
+		TLSMinVersion: tls.VersionTLS12,
+
+		SSHHostKey:        "ssh_host_key",
+		SSHAuthorizedKeys: "ssh_authorized_keys",
+
+		ShutdownMessage: "The server is shutting down. Goodbye!",
+		ShutdownTimeout: 5 * time.Second,
+
+		Moderation: true,
+	}
+}
+
+// ParseArgs builds a Config from command line arguments of the form
+// "[options] [port]", falling back to DefaultConfig for anything not given.
+func ParseArgs(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := newFlagSet(&cfg)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	switch rest := fs.Args(); {
+	case len(rest) == 0:
+		// default port
+	case len(rest) == 1 && Check(rest[0]):
+		cfg.ListenAddr = ":" + rest[0]
+		if len(cfg.Listen) > 0 {
+			// the port is one more listener alongside those given with -listen
+			cfg.Listen = append(cfg.Listen, ListenSpec{Network: "tcp", Address: cfg.ListenAddr, TLS: cfg.TLSCert != ""})
+		}
+	default:
+		return cfg, errors.New("expected a single numeric port")
+	}
+	return cfg, nil
+}
+
+// PrintUsage writes the usage line and every option with its default to w.
+func PrintUsage(w io.Writer) {
+	cfg := DefaultConfig()
+	fs := newFlagSet(&cfg)
+	fs.SetOutput(w)
+	fmt.Fprintln(w, "[USAGE]: ./TCPChat [options] [$port]")
+	fs.PrintDefaults()
+}
+
+// newFlagSet declares the server's command line options, storing parsed values in cfg.
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("TCPChat", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Func("listen", "extra address to accept connections on, may be repeated: host:port, tls:host:port or unix:path", func(v string) error {
+		spec, err := ParseListenSpec(v)
+		cfg.Listen = append(cfg.Listen, spec)
+		return err
+	})
+	fs.StringVar(&cfg.HTTPAddr, "http", cfg.HTTPAddr, "address to serve the web chat and its WebSocket gateway on, such as :8080")
+	fs.IntVar(&cfg.QueueSize, "queue-size", cfg.QueueSize, "outbound messages buffered per client")
+	fs.DurationVar(&cfg.SlowTimeout, "slow-timeout", cfg.SlowTimeout, "how long a full queue is tolerated with -slow-policy=disconnect")
+	fs.Func("slow-policy", "what to do when a client falls behind: drop-oldest, disconnect or block (default drop-oldest)", func(v string) error {
+		p, err := ParseSlowPolicy(v)
+		cfg.SlowPolicy = p
+		return err
+	})
+	fs.IntVar(&cfg.HistoryLimit, "history-size", cfg.HistoryLimit, "messages of history kept per room, 0 for no limit")
+	fs.DurationVar(&cfg.HistoryMaxAge, "history-age", cfg.HistoryMaxAge, "how long room history is kept, 0 for no limit")
+	fs.StringVar(&cfg.HistoryDir, "history-dir", cfg.HistoryDir, "directory room history is saved to, empty to keep history in memory only")
+	fs.IntVar(&cfg.MailboxLimit, "mailbox-size", cfg.MailboxLimit, "direct messages queued for each offline user")
+	fs.StringVar(&cfg.AccountsFile, "accounts", cfg.AccountsFile, "file registered names and password hashes are kept in, empty to disable /register")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "certificate file (PEM) to serve TLS instead of plain TCP")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "private key file (PEM) for -tls-cert")
+	fs.Func("tls-min-version", "oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3 (default 1.2)", func(v string) error {
+		version, err := ParseTLSVersion(v)
+		cfg.TLSMinVersion = version
+		return err
+	})
+	fs.StringVar(&cfg.SSHAddr, "ssh", cfg.SSHAddr, "address to accept SSH logins on, such as :2222")
+	fs.StringVar(&cfg.SSHHostKey, "ssh-host-key", cfg.SSHHostKey, "the server's SSH host key, generated if the file does not exist")
+	fs.StringVar(&cfg.SSHAuthorizedKeys, "ssh-keys", cfg.SSHAuthorizedKeys, "authorized_keys style file listing each SSH key with the user name it logs in as")
+	fs.StringVar(&cfg.ShutdownMessage, "shutdown-message", cfg.ShutdownMessage, "what clients are told when the server shuts down")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long clients get to receive their last messages when the server shuts down")
+	fs.BoolVar(&cfg.Moderation, "moderation", cfg.Moderation, "make whoever opens a room its operator, with /kick, /ban and /mute")
+	fs.Func("admins", "comma separated names that are operators of every room; they must be registered or verified", func(v string) error {
+		cfg.Admins = nameList(v)
+		return nil
+	})
+	fs.Func("verified-names", "comma separated names that can only log in with a client certificate or SSH key, such as the common names of client certificates", func(v string) error {
+		cfg.VerifiedNames = nameList(v)
+		return nil
+	})
+	fs.StringVar(&cfg.TLSClientCA, "tls-client-ca", cfg.TLSClientCA, "require client certificates signed by a CA in this PEM file and use their common name as the user name")
+	return fs
+}
+
+// nameList splits a comma separated list of names, dropping blanks.
+func nameList(v string) []string {
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    Config
+		wantErr bool
+	}{
+		{
+			name: "Defaults",
+			args: nil,
+			want: DefaultConfig(),
+		},
+		{
+			name: "Port and policy",
+			args: []string{"-slow-policy", "disconnect", "-slow-timeout", "3s", "-queue-size", "8", "2525"},
+			want: func() Config {
+				cfg := DefaultConfig()
+				cfg.ListenAddr = ":2525"
+				cfg.QueueSize = 8
+				cfg.SlowPolicy = Disconnect
+				cfg.SlowTimeout = 3 * time.Second
+				return cfg
+			}(),
+		},
+		{
+			name: "History limits",
+			args: []string{"-history-size", "0", "-history-age", "1h"},
+			want: func() Config {
+				cfg := DefaultConfig()
+				cfg.HistoryLimit = 0
+				cfg.HistoryMaxAge = time.Hour
+				return cfg
+			}(),
+		},
+		{
+			name: "TLS",
+			args: []string{"-tls-cert", "chat.pem", "-tls-key", "chat.key", "-tls-min-version", "1.3", "-tls-client-ca", "ca.pem"},
+			want: func() Config {
+				cfg := DefaultConfig()
+				cfg.TLSCert = "chat.pem"
+				cfg.TLSKey = "chat.key"
+				cfg.TLSMinVersion = tls.VersionTLS13
+				cfg.TLSClientCA = "ca.pem"
+				return cfg
+			}(),
+		},
+		{
+			name: "Listeners",
+			args: []string{"-listen", "127.0.0.1:9000", "-listen", "unix:/run/chat.sock", "-listen", "[::1]:8989", "2525"},
+			want: func() Config {
+				cfg := DefaultConfig()
+				cfg.ListenAddr = ":2525"
+				cfg.Listen = []ListenSpec{
+					{Network: "tcp", Address: "127.0.0.1:9000"},
+					{Network: "unix", Address: "/run/chat.sock"},
+					{Network: "tcp", Address: "[::1]:8989"},
+					{Network: "tcp", Address: ":2525"},
+				}
+				return cfg
+			}(),
+		},
+		{
+			name: "Shutdown",
+			args: []string{"-shutdown-message", "Back soon", "-shutdown-timeout", "500ms"},
+			want: func() Config {
+				cfg := DefaultConfig()
+				cfg.ShutdownMessage = "Back soon"
+				cfg.ShutdownTimeout = 500 * time.Millisecond
+				return cfg
+			}(),
+		},
+		{
+			name: "Moderation",
+			args: []string{"-moderation=false", "-admins", "alice, bob,", "-verified-names", "carol"},
+			want: func() Config {
+				cfg := DefaultConfig()
+				cfg.Moderation = false
+				cfg.Admins = []string{"alice", "bob"}
+				cfg.VerifiedNames = []string{"carol"}
+				return cfg
+			}(),
+		},
+		{
+			name:    "Bad listener",
+			args:    []string{"-listen", "8989"},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown policy",
+			args:    []string{"-slow-policy", "panic"},
+			wantErr: true,
+		},
+		{
+			name:    "Non numeric port",
+			args:    []string{"localhost"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseArgs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
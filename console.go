@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// consoleHelp describes the commands understood on the server's stdin.
+const consoleHelp = `Console commands:
+  list               connected users with their addresses and rooms
+  rooms              rooms and who is in them
+  stats              connection, room and message counts
+  kick <user>        disconnect a user
+  ban <ip>           disconnect everyone from an address and refuse it from now on
+  unban <ip>         accept connections from an address again
+  broadcast <text>   announce text to everyone in every room
+  reload             re-read the TLS certificate and SSH authorized keys
+  shutdown [seconds] stop the server, after counting down if seconds is given
+  exit               stop the server now
+`
+
+// runConsole reads operator commands from in until it ends, writing replies
+// to out. stop is called to shut the server down.
+func (s *Server) runConsole(in io.Reader, out io.Writer, stop func()) {
+	scanner := bufio.NewScanner(in)
+	stopping := false
+	for scanner.Scan() {
+		name, arg, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		arg = strings.TrimSpace(arg)
+
+		switch name {
+		case "":
+		case "help":
+			fmt.Fprint(out, consoleHelp)
+		case "list":
+			s.consoleList(out)
+		case "rooms":
+			s.consoleRooms(out)
+		case "stats":
+			s.consoleStats(out)
+		case "kick":
+			s.consoleKick(out, arg)
+		case "ban":
+			s.consoleBan(out, arg, true)
+		case "unban":
+			s.consoleBan(out, arg, false)
+		case "broadcast":
+			if arg == "" {
+				fmt.Fprintln(out, "Usage: broadcast <text>")
+				continue
+			}
+			s.broadcast(arg)
+		case "reload":
+			s.consoleReload(out)
+		case "shutdown":
+			seconds := 0
+			if arg != "" {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n < 0 {
+					fmt.Fprintln(out, "Usage: shutdown [seconds]")
+					continue
+				}
+				seconds = n
+			}
+			if stopping {
+				fmt.Fprintln(out, "The server is already shutting down.")
+				continue
+			}
+			stopping = true
+			fmt.Fprintln(out, "\nServer shutting down...")
+			go s.countdown(seconds, stop)
+		case "exit":
+			fmt.Fprintln(out, "\nServer shutting down...")
+			stop()
+			return
+		default:
+			fmt.Fprintf(out, "Unknown command %q. Type help for a list.\n", name)
+		}
+	}
+}
+
+// connectedClients returns every logged in client, sorted by name.
+func (s *Server) connectedClients() []*Client {
+	s.mu.RLock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(clients, func(a, b *Client) int { return strings.Compare(a.Name(), b.Name()) })
+	return clients
+}
+
+// consoleList handles "list".
+func (s *Server) consoleList(out io.Writer) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tADDRESS\tROOM")
+	for _, c := range s.connectedClients() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Name(), c.RemoteAddr(), c.Room())
+	}
+	tw.Flush()
+}
+
+// consoleRooms handles "rooms".
+func (s *Server) consoleRooms(out io.Writer) {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.rooms))
+	members := make(map[string][]string, len(s.rooms))
+	for room, clients := range s.rooms {
+		names = append(names, room)
+		for _, c := range clients {
+			members[room] = append(members[room], c.userName)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.Sort(names)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROOM\tUSERS\tMEMBERS")
+	for _, room := range names {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", room, len(members[room]), strings.Join(members[room], ", "))
+	}
+	tw.Flush()
+}
+
+// consoleStats handles "stats".
+func (s *Server) consoleStats(out io.Writer) {
+	s.mu.RLock()
+	users, rooms, banned := len(s.clients), len(s.rooms), len(s.bannedIPs)
+	history := 0
+	for _, msgs := range s.history {
+		history += len(msgs)
+	}
+	s.mu.RUnlock()
+
+	fmt.Fprintf(out, "uptime:           %s\n", time.Since(s.started).Round(time.Second))
+	fmt.Fprintf(out, "connections:      %d of %d\n", len(s.sem), cap(s.sem))
+	fmt.Fprintf(out, "users:            %d\n", users)
+	fmt.Fprintf(out, "rooms:            %d\n", rooms)
+	fmt.Fprintf(out, "history messages: %d\n", history)
+	fmt.Fprintf(out, "dropped messages: %d\n", s.DroppedMessages())
+	fmt.Fprintf(out, "banned addresses: %d\n", banned)
+}
+
+// consoleKick handles "kick <user>".
+func (s *Server) consoleKick(out io.Writer, userName string) {
+	if userName == "" {
+		fmt.Fprintln(out, "Usage: kick <user>")
+		return
+	}
+	client := s.findClient(userName)
+	if client == nil {
+		fmt.Fprintf(out, "%s is not online.\n", userName)
+		return
+	}
+	s.disconnect(client, "You have been disconnected by the server operator.\n")
+	fmt.Fprintf(out, "Disconnected %s (%s).\n", userName, client.RemoteAddr())
+}
+
+// consoleBan handles "ban <ip>" and "unban <ip>".
+func (s *Server) consoleBan(out io.Writer, addr string, ban bool) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		fmt.Fprintf(out, "%q is not an IP address.\n", addr)
+		return
+	}
+	addr = ip.String()
+
+	s.mu.Lock()
+	was := s.bannedIPs[addr]
+	if ban {
+		s.bannedIPs[addr] = true
+	} else {
+		delete(s.bannedIPs, addr)
+	}
+	s.mu.Unlock()
+
+	if !ban {
+		if !was {
+			fmt.Fprintf(out, "%s is not banned.\n", addr)
+			return
+		}
+		fmt.Fprintf(out, "Unbanned %s.\n", addr)
+		return
+	}
+
+	kicked := 0
+	for _, c := range s.connectedClients() {
+		if clientIP(c) == addr {
+			s.disconnect(c, "You have been banned from this server.\n")
+			kicked++
+		}
+	}
+	fmt.Fprintf(out, "Banned %s, disconnecting %s.\n", addr, plural(kicked, "user"))
+}
+
+// consoleReload handles "reload".
+func (s *Server) consoleReload(out io.Writer) {
+	reloaded, err := s.reload()
+	for _, what := range reloaded {
+		fmt.Fprintf(out, "Reloaded %s.\n", what)
+	}
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return
+	}
+	if len(reloaded) == 0 {
+		fmt.Fprintln(out, "Nothing to reload: the server has no TLS certificate or SSH keys.")
+	}
+}
+
+// reload re-reads the TLS certificate and SSH authorized keys the server was
+// started with. Anything that fails to load keeps its old settings. It returns
+// what was reloaded.
+func (s *Server) reload() ([]string, error) {
+	var reloaded []string
+	if s.tls != nil {
+		tlsConfig, err := loadTLSConfig(s.config)
+		if err != nil {
+			return reloaded, err
+		}
+		s.tlsLoaded.Store(tlsConfig)
+		reloaded = append(reloaded, "TLS certificate")
+	}
+	if s.sshConfig != nil {
+		keys, err := loadAuthorizedKeys(s.config.SSHAuthorizedKeys)
+		if err != nil {
+			return reloaded, fmt.Errorf("loading SSH authorized keys: %v", err)
+		}
+		s.sshKeys.Store(&keys)
+		reloaded = append(reloaded, fmt.Sprintf("%d SSH keys", len(keys)))
+	}
+	return reloaded, nil
+}
+
+// broadcast announces text to every connected client, whichever room they are in.
+func (s *Server) broadcast(text string) {
+	ev := Event{Type: EventNotice, Text: text}
+	s.Logs(fmt.Sprintf("[SERVER]: %s\n", text))
+	message := []byte(fmt.Sprintf("\r\033[33m[SERVER]: %s\033[0m\n", text))
+	for _, c := range s.connectedClients() {
+		s.sendEvent(c, message, ev)
+	}
+}
+
+// disconnect tells client why it is being disconnected and ends its session.
+// Its read loop stops and the usual cleanup flushes reason to it before the
+// connection closes. Nothing here waits for the client: a goodbye that does not
+// fit in a full queue is dropped, whatever the slow consumer policy.
+func (s *Server) disconnect(client *Client, reason string) {
+	if conn, ok := client.conn.(*sshConn); ok {
+		// SSH sessions ignore deadlines, so the goodbye cannot wait for the queue.
+		// A peer that stops reading holds up only this goroutine, until its connection is cut.
+		go func() {
+			conn.Write([]byte(reason))
+			conn.Close()
+		}()
+		return
+	}
+	// queued ahead of the read deadline, so the cleanup it sets off flushes it
+	s.trySend(client, []byte(reason))
+	client.conn.SetReadDeadline(time.Now())
+}
+
+// countdownAt lists the remaining seconds a shutdown countdown is announced at.
+var countdownAt = []int{600, 300, 120, 60, 30, 10, 5, 4, 3, 2, 1}
+
+// countdown announces the shutdown to everyone over the given number of
+// seconds, then calls stop.
+func (s *Server) countdown(seconds int, stop func()) {
+	if seconds > 0 {
+		s.broadcast(fmt.Sprintf("The server is shutting down in %s.", plural(seconds, "second")))
+	}
+	for left := seconds; left > 0; left-- {
+		if left < seconds && slices.Contains(countdownAt, left) {
+			s.broadcast(fmt.Sprintf("Shutting down in %s...", plural(left, "second")))
+		}
+		time.Sleep(time.Second)
+	}
+	stop()
+}
+
+// plural formats n with unit, adding an s unless n is 1.
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServer_console(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	bob.send("/join lobby")
+	bob.waitFor(t, "You have joined: lobby")
+
+	var out strings.Builder
+	stopped := false
+	s.runConsole(strings.NewReader("list\nrooms\nstats\nbroadcast back in five\nkick bob\nkick dave\nban pipe\nfrobnicate\nexit\nstats\n"), &out, func() { stopped = true })
+
+	for _, want := range []string{
+		"USER   ADDRESS  ROOM\nalice  pipe     room1_:0\nbob    pipe     lobby\n",
+		"ROOM      USERS  MEMBERS\nlobby     1      bob\nroom1_:0  1      alice\n",
+		"users:            2\n",
+		"Disconnected bob (pipe).\n",
+		"dave is not online.\n",
+		`"pipe" is not an IP address.`,
+		`Unknown command "frobnicate".`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("console output %q is missing %q", out.String(), want)
+		}
+	}
+	if !stopped {
+		t.Error("exit did not stop the server")
+	}
+	if strings.Count(out.String(), "uptime:") != 1 {
+		t.Error("the console kept reading after exit")
+	}
+
+	alice.waitFor(t, "[SERVER]: back in five")
+	bob.waitFor(t, "[SERVER]: back in five")
+	bob.waitFor(t, "You have been disconnected by the server operator.")
+	alice.waitFor(t, "bob has left the room!")
+
+	alice.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_consoleBan(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.HistoryDir = ""
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestServer(t, s)
+	ln := s.listeners[0]
+
+	alice, aliceR := dialAndLogin(t, ln, "alice")
+	var out strings.Builder
+	s.runConsole(strings.NewReader("ban 127.0.0.1\n"), &out, func() {})
+	if want := "Banned 127.0.0.1, disconnecting 1 user."; !strings.Contains(out.String(), want) {
+		t.Errorf("console output = %q, want %q", out.String(), want)
+	}
+	readUntil(t, alice, aliceR, "You have been banned from this server.")
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, bufio.NewReader(conn), "You are banned from this server.")
+
+	s.runConsole(strings.NewReader("unban 127.0.0.1\nunban 127.0.0.1\n"), &out, func() {})
+	if want := "Unbanned 127.0.0.1.\n127.0.0.1 is not banned."; !strings.Contains(out.String(), want) {
+		t.Errorf("console output = %q, want %q", out.String(), want)
+	}
+	dialAndLogin(t, ln, "alice")
+}
+
+func TestServer_consoleShutdownCountdown(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	var out strings.Builder
+	var stopped atomic.Bool
+	start := time.Now()
+	s.runConsole(strings.NewReader("shutdown soon\nshutdown 2\nshutdown\n"), &out, func() { stopped.Store(true) })
+	for _, want := range []string{"Usage: shutdown [seconds]", "The server is already shutting down."} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("console output %q is missing %q", out.String(), want)
+		}
+	}
+
+	alice.waitFor(t, "[SERVER]: The server is shutting down in 2 seconds.")
+	alice.waitFor(t, "[SERVER]: Shutting down in 1 second...")
+	for !stopped.Load() {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the countdown never stopped the server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("the server stopped after %v, want 2s", elapsed)
+	}
+
+	alice.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_reload(t *testing.T) {
+	alice, carol := newTestSigner(t), newTestSigner(t)
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.SSHAddr = "127.0.0.1:0"
+	cfg.SSHHostKey = filepath.Join(dir, "host_key")
+	cfg.SSHAuthorizedKeys = filepath.Join(dir, "keys")
+	os.WriteFile(cfg.SSHAuthorizedKeys, []byte(authorizedKeyLine(alice, "alice")), 0o600)
+
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", cfg.SSHAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.serveSSH(ln)
+
+	canLogIn := func(signer ssh.Signer) bool {
+		client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+			User:            "whoever",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         3 * time.Second,
+		})
+		if err != nil {
+			return false
+		}
+		client.Close()
+		return true
+	}
+
+	if canLogIn(carol) {
+		t.Fatal("carol logged in before their key was added")
+	}
+	os.WriteFile(cfg.SSHAuthorizedKeys, []byte(authorizedKeyLine(alice, "alice")+authorizedKeyLine(carol, "carol")), 0o600)
+	var out strings.Builder
+	s.runConsole(strings.NewReader("reload\n"), &out, func() {})
+	if want := "Reloaded 2 SSH keys."; !strings.Contains(out.String(), want) {
+		t.Errorf("console output = %q, want %q", out.String(), want)
+	}
+	if !canLogIn(carol) {
+		t.Error("carol could not log in after reload")
+	}
+
+	// a broken file keeps the keys already loaded
+	os.WriteFile(cfg.SSHAuthorizedKeys, []byte("not a key\n"), 0o600)
+	out.Reset()
+	s.runConsole(strings.NewReader("reload\n"), &out, func() {})
+	if !strings.Contains(out.String(), "loading SSH authorized keys") {
+		t.Errorf("console output = %q, want the load error", out.String())
+	}
+	if !canLogIn(alice) || !canLogIn(carol) {
+		t.Error("a failed reload dropped the keys already loaded")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// findClient returns the connected client called userName, or nil if nobody by that name is online.
+func (s *Server) findClient(userName string) *Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.clients {
+		if c.userName == userName {
+			return c
+		}
+	}
+	return nil
+}
+
+// replyDM handles "/r <text>", answering whoever last sent the client a direct message.
+func (s *Server) replyDM(client *Client, text string) {
+	s.mu.RLock()
+	to := client.lastDM
+	s.mu.RUnlock()
+	if to == "" {
+		s.sendError(client, "Nobody has sent you a direct message yet.\n")
+		return
+	}
+	s.deliverDM(client, to, text)
+}
+
+// deliverDM sends text from client to the user called to, and to nobody else.
+func (s *Server) deliverDM(client *Client, to, text string) {
+	target := s.findClient(to)
+
+	s.mu.Lock()
+	from := client.userName
+	if target != nil {
+		target.lastDM = from
+	}
+	s.mu.Unlock()
+
+	if target == nil {
+		s.queueDM(client, from, to, text)
+		return
+	}
+
+	now := time.Now()
+	timestamp := now.Format("2006-01-02 15:04:05")
+	ev := Event{Type: EventDM, ID: s.newMessageID(), From: from, To: to, Text: text, Time: now}
+	s.sendEvent(target, []byte(fmt.Sprintf("\033[35m[%s][DM from %s]:\033[0m %s\n", timestamp, from, text)), ev)
+	s.sendEvent(client, []byte(fmt.Sprintf("\033[35m[%s][DM to %s]:\033[0m %s\n", timestamp, to, text)), ev)
+	LogDM(fmt.Sprintf("[%s][%s -> %s]:%s\n", timestamp, from, to, text))
+}
+
+// LogDM appends a direct message to "dm.log", kept apart from the room history.
+func LogDM(msg string) {
+	mu.Lock()
+	defer mu.Unlock()
+	fd, err := os.OpenFile("dm.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer fd.Close()
+	fd.WriteString(msg)
+}
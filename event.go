@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Event types sent to clients speaking the JSON lines protocol.
+const (
+	EventWelcome = "welcome" // connection accepted, login follows
+	EventPrompt  = "prompt"  // the server is waiting for Field
+	EventMessage = "message" // a chat message in Room
+	EventJoin    = "join"    // From joined Room
+	EventLeave   = "leave"   // From left Room
+	EventRename  = "rename"  // From is now called To
+	EventTopic   = "topic"   // From set the topic of Room to Text; also sent on joining a room with a topic
+	EventMode    = "mode"    // From changed the modes of Room by Text: +k, -k, +i or -i
+	EventInvite  = "invite"  // From invited To into Room
+	EventDM      = "dm"      // a direct message From one user To another
+	EventOp      = "op"      // From made To an operator of Room; From is empty for whoever opened the room
+	EventDeop    = "deop"    // From took away To's operator rights in Room
+	EventKick    = "kick"    // From removed To from Room, giving Text as the reason
+	EventBan     = "ban"     // From banned To, a user name or IP address, from Room
+	EventUnban   = "unban"   // From lifted the ban on To in Room
+	EventMute    = "mute"    // From muted To in Room, for Text if it is a duration, or until unmuted
+	EventUnmute  = "unmute"  // From unmuted To in Room
+	EventNotice  = "notice"  // an announcement to everyone from whoever runs the server
+	EventInfo    = "info"    // any other server output, as plain text
+	EventError   = "error"   // a command failed
+	EventOK      = "ok"      // the request ReplyTo succeeded
+)
+
+// Event is something that happened on the server. Text clients see it as
+// formatted text; structured clients receive it as a line of JSON.
+type Event struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`       // the message's ID, on message and dm events, and on ok for a chat line
+	ReplyTo string    `json:"reply_to,omitempty"` // id of the request this answers, on ok and error events
+	Room    string    `json:"room,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Field   string    `json:"field,omitempty"`   // what a prompt asks for: "name" or "password"
+	History bool      `json:"history,omitempty"` // the message is replayed from history
+	Time    time.Time `json:"time"`
+}
+
+// Handshake lines a client sends on connecting, before the server says anything,
+// to speak the JSON lines protocol instead of text.
+const (
+	jsonHandshake = "HELLO json"
+	botHandshake  = "HELLO bot" // the name the protocol had when only bots used it
+)
+
+// handshakeWait is how long a new connection is given to send a handshake before it is treated as a person.
+const handshakeWait = 250 * time.Millisecond
+
+// negotiate checks whether the connection opens with a protocol handshake and consumes it.
+// Anything else the client sent early stays buffered for the name prompt.
+// ok is false if the client asked for a protocol the server does not speak.
+func negotiate(conn net.Conn, reader *bufio.Reader) (structured bool, ok bool) {
+	conn.SetReadDeadline(time.Now().Add(handshakeWait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	prefix, _ := reader.Peek(len("HELLO "))
+	if string(prefix) != "HELLO " {
+		return false, true
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * handshakeWait))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return false, false
+	}
+	if hello := strings.TrimSpace(line); hello != jsonHandshake && hello != botHandshake {
+		conn.Write([]byte(fmt.Sprintf("Unsupported protocol %q. Disconnecting...\n", strings.TrimSpace(line))))
+		return false, false
+	}
+	return true, true
+}
+
+// ansiEscape matches the terminal control sequences used in text output.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+// plainText strips terminal escapes and surrounding blank space from text output.
+func plainText(msg []byte) string {
+	return strings.TrimSpace(strings.ReplaceAll(ansiEscape.ReplaceAllString(string(msg), ""), "\r", ""))
+}
+
+// encodeEvent renders ev as a JSON line, stamping it with the current time if it has none.
+func encodeEvent(ev Event) []byte {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	line, _ := json.Marshal(ev)
+	return append(line, '\n')
+}
+
+// sendEvent queues ev for client: as JSON for structured clients, or as text for everyone else.
+func (s *Server) sendEvent(client *Client, text []byte, ev Event) {
+	if client.structured {
+		s.enqueue(client, encodeEvent(ev))
+		return
+	}
+	s.enqueue(client, text)
+}
+
+// sendError tells client that something it asked for failed. It answers the
+// request being handled, so it must only be called from the client's own goroutine.
+func (s *Server) sendError(client *Client, text string) {
+	client.requestFailed = true
+	s.sendEvent(client, []byte(text), Event{Type: EventError, ReplyTo: client.request, Text: plainText([]byte(text))})
+}
+
+// acknowledge answers the request being handled with an ok event, unless an
+// error already answered it. msgID is the ID given to the chat line, if any.
+func (s *Server) acknowledge(client *Client, msgID string) {
+	if client.structured && client.request != "" && !client.requestFailed {
+		s.enqueue(client, encodeEvent(Event{Type: EventOK, ReplyTo: client.request, ID: msgID}))
+	}
+}
+
+// request is a JSON line sent by a structured client. A request without a
+// command, or with "say", is a chat message; any other command runs the slash
+// command of that name. ID is optional and is echoed back as reply_to.
+type request struct {
+	ID   string   `json:"id"`
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args"`
+	Text string   `json:"text"`
+}
+
+// translateRequest turns a JSON request into the text line a person would type,
+// returning it with the request's id. Lines that are not JSON objects are passed through unchanged.
+func translateRequest(line string) (string, string, error) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "{") {
+		return line, "", nil
+	}
+	var req request
+	if err := json.Unmarshal([]byte(trimmed), &req); err != nil {
+		return "", "", fmt.Errorf("invalid JSON request: %v", err)
+	}
+	if hasControl(req.Cmd) || hasControl(req.Text) || slices.ContainsFunc(req.Args, hasControl) {
+		return "", req.ID, fmt.Errorf("requests may not contain line breaks or other control characters")
+	}
+
+	switch strings.TrimPrefix(req.Cmd, "/") {
+	case "", "say":
+		if strings.HasPrefix(req.Text, "/") {
+			return "", req.ID, fmt.Errorf("chat text may not start with /, use \"cmd\" to run commands")
+		}
+		return req.Text + "\n", req.ID, nil
+	default:
+		parts := append([]string{"/" + strings.TrimPrefix(req.Cmd, "/")}, req.Args...)
+		if req.Text != "" {
+			parts = append(parts, req.Text)
+		}
+		return strings.Join(parts, " ") + "\n", req.ID, nil
+	}
+}
+
+// hasControl reports whether s holds a control character other than tab, such
+// as a line break that would let one request pass for several lines of output.
+func hasControl(s string) bool {
+	return strings.ContainsFunc(s, func(r rune) bool { return unicode.IsControl(r) && r != '\t' })
+}
+
+// readLine reads the next line from client, translating JSON requests and
+// remembering their id so the answer can refer back to it.
+func (s *Server) readLine(client *Client) (string, error) {
+	for {
+		line, err := client.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if !client.structured {
+			return line, nil
+		}
+		translated, id, err := translateRequest(line)
+		client.request, client.requestFailed = id, false
+		if err != nil {
+			s.sendError(client, err.Error())
+			continue
+		}
+		return translated, nil
+	}
+}
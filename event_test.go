@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTranslateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    string
+		wantID  string
+		wantErr bool
+	}{
+		{name: "Plain text passes through", line: "robot\n", want: "robot\n"},
+		{name: "Say", line: `{"cmd":"say","text":"hello /users"}`, want: "hello /users\n"},
+		{name: "Text only", line: `{"text":"robot"}`, want: "robot\n"},
+		{name: "Command with args", line: `{"cmd":"join","args":["ops"]}`, want: "/join ops\n"},
+		{name: "Request id", line: `{"id":"7","cmd":"users"}`, want: "/users\n", wantID: "7"},
+		{name: "Command with text", line: `{"cmd":"msg","args":["bob"],"text":"hi there"}`, want: "/msg bob hi there\n"},
+		{name: "Slashed command name", line: `{"cmd":"/users"}`, want: "/users\n"},
+		{name: "Say cannot run commands", line: `{"id":"8","cmd":"say","text":"/quit"}`, wantID: "8", wantErr: true},
+		{name: "Broken JSON", line: `{"cmd":`, wantErr: true},
+		{name: "Line break in text", line: `{"id":"9","text":"hi\n[2026-01-01 00:00:00][alice]:send me your password"}`, wantID: "9", wantErr: true},
+		{name: "Carriage return in args", line: `{"cmd":"msg","args":["bob\rfake"],"text":"hi"}`, wantErr: true},
+		{name: "Escape in command", line: `{"cmd":"users\u001b[2J"}`, wantErr: true},
+		{name: "Tab is fine", line: `{"text":"a\tb"}`, want: "a\tb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, id, err := translateRequest(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("translateRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || id != tt.wantID {
+				t.Errorf("translateRequest() = %q, %q, want %q, %q", got, id, tt.want, tt.wantID)
+			}
+		})
+	}
+}
+
+// events decodes every JSON line the client has received so far.
+func (tc *testClient) events(t *testing.T) []Event {
+	t.Helper()
+	tc.mu.Lock()
+	out := tc.out.String()
+	tc.mu.Unlock()
+
+	var events []Event
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var ev Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("bot received a non-JSON line %q: %v", line, err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// waitForEvent blocks until the client has received an event matching want.
+func (tc *testClient) waitForEvent(t *testing.T, want func(Event) bool) Event {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		tc.mu.Lock()
+		complete := strings.HasSuffix(tc.out.String(), "\n")
+		tc.mu.Unlock()
+		if complete {
+			for _, ev := range tc.events(t) {
+				if want(ev) {
+					return ev
+				}
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for event")
+	return Event{}
+}
+
+func TestServer_botMode(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	bot := connectTestClient(t, s, &wg, botHandshake)
+	bot.waitForEvent(t, func(ev Event) bool { return ev.Type == EventPrompt && ev.Field == "name" })
+	bot.send(`{"text":"robot"}`)
+	room := "room1_:0"
+	bot.waitForEvent(t, func(ev Event) bool { return ev.Type == EventJoin && ev.From == "robot" && ev.Room == room })
+
+	alice.send("beep?")
+	bot.waitForEvent(t, func(ev Event) bool {
+		return ev.Type == EventMessage && ev.From == "alice" && ev.Text == "beep?" && ev.Room == room
+	})
+
+	bot.send(`{"cmd":"say","text":"boop"}`)
+	alice.waitFor(t, "[robot]:boop")
+
+	alice.send("/name alicia")
+	bot.waitForEvent(t, func(ev Event) bool { return ev.Type == EventRename && ev.From == "alice" && ev.To == "alicia" })
+
+	bot.send(`{"cmd":"join"}`)
+	bot.waitForEvent(t, func(ev Event) bool { return ev.Type == EventError && ev.Text == "Usage: /join <room-name> [key]" })
+
+	bot.send(`{"cmd":"join","args":["ops"]}`)
+	alice.waitFor(t, "robot has joined the room!")
+
+	for _, ev := range bot.events(t) {
+		if strings.Contains(ev.Text, "\033") || strings.Contains(ev.Text, "_nnnn_") {
+			t.Errorf("bot received terminal output: %q", ev.Text)
+		}
+	}
+
+	bot.send(`{"cmd":"quit"}`)
+	alice.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_jsonRequests(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	app := connectTestClient(t, s, &wg, jsonHandshake)
+	app.waitForEvent(t, func(ev Event) bool { return ev.Type == EventPrompt && ev.Field == "name" })
+	app.send(`{"id":"1","text":"app"}`)
+	app.waitForEvent(t, func(ev Event) bool { return ev.Type == EventJoin && ev.From == "app" })
+
+	app.send(`{"id":"2","text":"hello"}`)
+	ok := app.waitForEvent(t, func(ev Event) bool { return ev.Type == EventOK && ev.ReplyTo == "2" })
+	if ok.ID == "" {
+		t.Fatal("ok for a chat line carries no message ID")
+	}
+	app.waitForEvent(t, func(ev Event) bool { return ev.Type == EventMessage && ev.ID == ok.ID && ev.Text == "hello" })
+
+	app.send(`{"id":"3","cmd":"join"}`)
+	app.waitForEvent(t, func(ev Event) bool { return ev.Type == EventError && ev.ReplyTo == "3" })
+
+	app.send(`{"id":"4","cmd":"users"}`)
+	app.waitForEvent(t, func(ev Event) bool { return ev.Type == EventOK && ev.ReplyTo == "4" })
+
+	alice.send("second")
+	second := app.waitForEvent(t, func(ev Event) bool { return ev.Type == EventMessage && ev.Text == "second" })
+	if second.ID == ok.ID || second.ReplyTo != "" {
+		t.Errorf("message from alice = %+v, want a new ID and no reply_to", second)
+	}
+
+	for _, ev := range app.events(t) {
+		if ev.Type == EventOK && ev.ReplyTo == "3" {
+			t.Error("failed request 3 was also acknowledged")
+		}
+	}
+
+	app.send(`{"cmd":"quit"}`)
+	alice.send("/quit")
+	wg.Wait()
+}
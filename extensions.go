@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// CommandHandler runs a custom slash command for client, who is in room (empty if
+// in none), with the arguments parsed according to the Command. A returned
+// error is shown to the client.
+type CommandHandler func(client *Client, room string, args []string) error
+
+// Command describes a custom slash command registered with Server.RegisterCommand.
+type Command struct {
+	Name    string // e.g. "/deploy"; the leading slash is optional
+	Args    string // argument synopsis for usage and /help, e.g. "<service>"
+	Help    string // one line description for /help
+	MinArgs int
+	MaxArgs int  // -1 for no limit
+	Rest    bool // the last argument takes the remainder of the line verbatim
+	Handler CommandHandler
+}
+
+// MessageHook is called after client's chat message text has been sent to room.
+type MessageHook func(client *Client, room, text string)
+
+// RoomHook is called after client has joined or left room.
+type RoomHook func(client *Client, room string)
+
+// Extension sets up a Server, typically by registering commands and hooks.
+type Extension func(s *Server) error
+
+var (
+	extensionsMu sync.Mutex
+	extensions   []Extension
+)
+
+// RegisterExtension adds ext to every Server created afterwards. Extensions are
+// compiled into the binary by adding a file to this package that calls
+// RegisterExtension from an init function.
+func RegisterExtension(ext Extension) {
+	extensionsMu.Lock()
+	extensions = append(extensions, ext)
+	extensionsMu.Unlock()
+}
+
+// applyExtensions runs every registered extension against s.
+func (s *Server) applyExtensions() error {
+	extensionsMu.Lock()
+	exts := append([]Extension(nil), extensions...)
+	extensionsMu.Unlock()
+
+	for _, ext := range exts {
+		if err := ext(s); err != nil {
+			return fmt.Errorf("loading extension: %w", err)
+		}
+	}
+	return nil
+}
+
+// RegisterCommand adds a custom slash command. It fails if the name is
+// malformed or already taken, including by a built-in command.
+func (s *Server) RegisterCommand(c Command) error {
+	name := c.Name
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	if len(name) < 2 || strings.ContainsAny(name, " \t\r\n") || strings.Count(name, "/") != 1 {
+		return fmt.Errorf("invalid command name %q", c.Name)
+	}
+	if c.Handler == nil {
+		return errors.New("command handler is nil")
+	}
+	if c.MaxArgs >= 0 && c.MaxArgs < c.MinArgs {
+		return fmt.Errorf("%s: MaxArgs is less than MinArgs", name)
+	}
+
+	s.extMu.Lock()
+	defer s.extMu.Unlock()
+	if _, exists := s.commands[name]; exists {
+		return fmt.Errorf("command %s is already registered", name)
+	}
+
+	handler := c.Handler
+	s.commandOrder = append(s.commandOrder, name)
+	s.commands[name] = &command{
+		name:    name,
+		args:    c.Args,
+		help:    c.Help,
+		minArgs: c.MinArgs,
+		maxArgs: c.MaxArgs,
+		rest:    c.Rest,
+		run: func(client *Client, args []string) {
+			if err := handler(client, client.Room(), args); err != nil {
+				s.sendError(client, fmt.Sprintf("%s: %v\n", name, err))
+			}
+		},
+	}
+	return nil
+}
+
+// OnMessage registers a hook run for every chat message sent to a room.
+func (s *Server) OnMessage(hook MessageHook) {
+	s.extMu.Lock()
+	s.messageHooks = append(s.messageHooks, hook)
+	s.extMu.Unlock()
+}
+
+// OnJoin registers a hook run whenever a client joins a room.
+func (s *Server) OnJoin(hook RoomHook) {
+	s.extMu.Lock()
+	s.joinHooks = append(s.joinHooks, hook)
+	s.extMu.Unlock()
+}
+
+// OnLeave registers a hook run whenever a client leaves a room, including by disconnecting.
+func (s *Server) OnLeave(hook RoomHook) {
+	s.extMu.Lock()
+	s.leaveHooks = append(s.leaveHooks, hook)
+	s.extMu.Unlock()
+}
+
+// runMessageHooks calls every message hook. Hooks run on the sender's goroutine.
+func (s *Server) runMessageHooks(client *Client, room, text string) {
+	s.extMu.RLock()
+	hooks := s.messageHooks
+	s.extMu.RUnlock()
+	for _, hook := range hooks {
+		hook(client, room, text)
+	}
+}
+
+// runRoomHooks calls each of hooks for client and room.
+func (s *Server) runRoomHooks(hooks []RoomHook, client *Client, room string) {
+	for _, hook := range hooks {
+		hook(client, room)
+	}
+}
+
+// Send delivers text to client as a line from the server.
+func (s *Server) Send(client *Client, text string) {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	s.send(client, []byte(text))
+}
+
+// Announce delivers text to everyone in room.
+func (s *Server) Announce(room, text string) {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	s.mu.RLock()
+	members := s.rooms[room]
+	s.mu.RUnlock()
+	for _, c := range members {
+		s.send(c, []byte(text))
+	}
+}
+
+// Name returns the client's current user name.
+func (client *Client) Name() string {
+	client.server.mu.RLock()
+	defer client.server.mu.RUnlock()
+	return client.userName
+}
+
+// Room returns the room the client is in, or "" if none.
+func (client *Client) Room() string {
+	client.server.mu.RLock()
+	defer client.server.mu.RUnlock()
+	return client.room
+}
+
+// RemoteAddr returns the network address the client connected from.
+func (client *Client) RemoteAddr() net.Addr {
+	return client.conn.RemoteAddr()
+}
+
+// TerminalWidth returns the width of the client's terminal in columns, as
+// reported over telnet or SSH, or 0 if it is not known.
+func (client *Client) TerminalWidth() int {
+	if session, ok := client.conn.(*sshConn); ok {
+		return int(session.width.Load())
+	}
+	if client.telnet != nil {
+		return int(client.telnet.width.Load())
+	}
+	return 0
+}
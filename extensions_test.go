@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServer_RegisterCommand(t *testing.T) {
+	s, _ := NewServer(":0")
+	noop := func(*Client, string, []string) error { return nil }
+	tests := []struct {
+		name    string
+		cmd     Command
+		wantErr bool
+	}{
+		{name: "Valid", cmd: Command{Name: "/deploy", Handler: noop}},
+		{name: "Slash optional", cmd: Command{Name: "oncall", Handler: noop}},
+		{name: "Built-in taken", cmd: Command{Name: "/join", Handler: noop}, wantErr: true},
+		{name: "Duplicate", cmd: Command{Name: "/deploy", Handler: noop}, wantErr: true},
+		{name: "Space in name", cmd: Command{Name: "/on call", Handler: noop}, wantErr: true},
+		{name: "Missing handler", cmd: Command{Name: "/status"}, wantErr: true},
+		{name: "Bad arity", cmd: Command{Name: "/status", MinArgs: 2, MaxArgs: 1, Handler: noop}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.RegisterCommand(tt.cmd); (err != nil) != tt.wantErr {
+				t.Errorf("RegisterCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_extensionCommandsAndHooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	RegisterExtension(func(s *Server) error {
+		s.OnJoin(func(client *Client, room string) { record("join " + client.Name() + " " + room) })
+		s.OnLeave(func(client *Client, room string) { record("leave " + client.Name() + " " + room) })
+		s.OnMessage(func(client *Client, room, text string) { record("message " + client.Name() + " " + text) })
+		return s.RegisterCommand(Command{
+			Name: "/deploy", Args: "<service>", Help: "Show deploy status", MinArgs: 1, MaxArgs: 1,
+			Handler: func(client *Client, room string, args []string) error {
+				if args[0] == "broken" {
+					return errors.New("no such service")
+				}
+				s.Send(client, args[0]+" is green in "+room)
+				return nil
+			},
+		})
+	})
+	defer func() {
+		extensionsMu.Lock()
+		extensions = extensions[:len(extensions)-1]
+		extensionsMu.Unlock()
+	}()
+
+	s, err := NewServer(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/join ops")
+	alice.waitFor(t, "You have joined: ops")
+	alice.send("/deploy api")
+	alice.waitFor(t, "api is green in ops")
+	alice.send("/deploy broken")
+	alice.waitFor(t, "/deploy: no such service")
+	alice.send("/help")
+	alice.waitFor(t, "/deploy <service>: Show deploy status")
+	alice.send("shipping it")
+	alice.waitFor(t, "[alice]:shipping it")
+	alice.send("/quit")
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "join alice room1_:0|leave alice room1_:0|join alice ops|message alice shipping it|leave alice ops"
+	if got := strings.Join(events, "|"); got != want {
+		t.Errorf("hook events = %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newMessageID returns an ID no other message has. IDs count up from the
+// time the server started, so they stay unique across restarts.
+func (s *Server) newMessageID() string {
+	return strconv.FormatUint(s.lastID.Add(1), 36)
+}
+
+// recordMessage appends msg to its room's history, trimming the history
+// to the configured size and age limits.
+func (s *Server) recordMessage(msg Message) {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+
+	s.mu.Lock()
+	// indexed under the lock, so it cannot be trimmed before it is added
+	s.index.add(msg)
+	s.keepHistory(msg.room, append(s.history[msg.room], msg), time.Now())
+	store := s.store
+	compacted, compact := s.compaction(msg.room)
+	s.mu.Unlock()
+
+	if store == nil {
+		return
+	}
+	if err := store.Append(msg); err != nil {
+		fmt.Println("Error saving message to history:", err)
+	}
+	if compact {
+		s.compactHistory(store, msg.room, compacted)
+	}
+}
+
+// compaction returns what should replace the stored history of room once as
+// many messages were trimmed from it as it keeps, so stored history stays
+// within about twice what is kept. The latest topic change is kept even once
+// trimmed, since loading history reads the topic back from it. ok is false if
+// no compaction is due. The caller must hold s.mu for writing.
+func (s *Server) compaction(room string) (msgs []Message, ok bool) {
+	kept := s.history[room]
+	if s.trimmed[room] == 0 || s.trimmed[room] < len(kept) {
+		return nil, false
+	}
+	delete(s.trimmed, room)
+	hasTopic := slices.ContainsFunc(kept, func(msg Message) bool { return msg.topic })
+	if topic := s.topicOf(room); topic.text != "" && !hasTopic {
+		msgs = append(msgs, Message{sender: topic.setBy, content: []byte(topic.text + "\n"), room: room, msgDate: topic.setAt, topic: true})
+	}
+	return append(msgs, kept...), true
+}
+
+// compactHistory replaces the stored history of room with msgs, if store can.
+func (s *Server) compactHistory(store HistoryStore, room string, msgs []Message) {
+	compactor, ok := store.(HistoryCompactor)
+	if !ok {
+		return
+	}
+	if err := compactor.Compact(room, msgs); err != nil {
+		fmt.Println("Error compacting history:", err)
+	}
+}
+
+// SetHistoryStore makes the server persist history to store instead of the
+// file store configured by HistoryDir. It must be called before Start. Unless
+// store is also a RoomModeStore, private rooms lose their modes on a restart.
+func (s *Server) SetHistoryStore(store HistoryStore) {
+	s.mu.Lock()
+	s.store = store
+	s.mu.Unlock()
+}
+
+// loadHistory opens the configured history store, if any, and fills the
+// in-memory room history from it.
+func (s *Server) loadHistory() error {
+	s.mu.Lock()
+	store := s.store
+	s.mu.Unlock()
+
+	if store == nil {
+		if s.config.HistoryDir == "" {
+			return nil
+		}
+		fileStore, err := OpenFileHistoryStore(s.config.HistoryDir)
+		if err != nil {
+			return err
+		}
+		store = fileStore
+	}
+
+	msgs, err := store.Load()
+	if err != nil {
+		store.Close()
+		return err
+	}
+	var modes map[string]RoomModes
+	if modeStore, ok := store.(RoomModeStore); ok {
+		if modes, err = modeStore.LoadModes(); err != nil {
+			store.Close()
+			return err
+		}
+	}
+	s.modesMu.Lock()
+	s.savedModes = modes
+	s.modesMu.Unlock()
+
+	s.mu.Lock()
+	s.store = store
+	for _, msg := range msgs {
+		if msg.id == "" {
+			// written before messages had IDs
+			msg.id = s.newMessageID()
+		}
+		s.history[msg.room] = append(s.history[msg.room], msg)
+		if msg.topic {
+			// the latest change is the room's topic
+			s.roomState(msg.room).topic = roomTopic{text: strings.TrimRight(string(msg.content), "\n"), setBy: msg.sender, setAt: msg.msgDate}
+		}
+	}
+	s.restoreModes(modes)
+	now := time.Now()
+	var kept []Message
+	compactions := make(map[string][]Message)
+	for room, roomMsgs := range s.history {
+		s.keepHistory(room, roomMsgs, now)
+		kept = append(kept, s.history[room]...)
+		if msgs, ok := s.compaction(room); ok {
+			compactions[room] = msgs
+		}
+	}
+	// index oldest first, as they were sent, so searches find the newest first
+	slices.SortStableFunc(kept, func(a, b Message) int { return a.msgDate.Compare(b.msgDate) })
+	for _, msg := range kept {
+		s.index.add(msg)
+	}
+	s.mu.Unlock()
+
+	for room, msgs := range compactions {
+		s.compactHistory(store, room, msgs)
+	}
+	return nil
+}
+
+// closeHistory closes the history store, if one is open.
+func (s *Server) closeHistory() {
+	s.mu.Lock()
+	store := s.store
+	s.mu.Unlock()
+
+	if store != nil {
+		if err := store.Close(); err != nil {
+			fmt.Println("Error closing history store:", err)
+		}
+	}
+}
+
+// keepHistory stores msgs as the history of room, trimmed to the configured
+// limits, and drops what was trimmed from the search index. What was trimmed
+// counts towards compacting the store. The caller must hold s.mu.
+func (s *Server) keepHistory(room string, msgs []Message, now time.Time) {
+	kept := s.trimHistory(msgs, now)
+	s.index.remove(msgs[:len(msgs)-len(kept)])
+	if s.store != nil {
+		s.trimmed[room] += len(msgs) - len(kept)
+	}
+	if len(kept) == 0 {
+		delete(s.history, room)
+		return
+	}
+	s.history[room] = kept
+}
+
+// trimHistory drops messages beyond HistoryLimit and older than HistoryMaxAge.
+// A zero limit or age means no limit. The caller must hold s.mu.
+func (s *Server) trimHistory(msgs []Message, now time.Time) []Message {
+	start := 0
+	if limit := s.config.HistoryLimit; limit > 0 && len(msgs) > limit {
+		start = len(msgs) - limit
+	}
+	if age := s.config.HistoryMaxAge; age > 0 {
+		for start < len(msgs) && now.Sub(msgs[start].msgDate) > age {
+			start++
+		}
+	}
+	if start == 0 {
+		return msgs
+	}
+	// copy so the dropped messages can be garbage collected
+	return append([]Message(nil), msgs[start:]...)
+}
+
+// roomHistory returns a copy of the unexpired messages sent to room.
+func (s *Server) roomHistory(room string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepHistory(room, s.history[room], time.Now())
+	return append([]Message(nil), s.history[room]...)
+}
+
+// replayHistory sends the history of room to client.
+func (s *Server) replayHistory(client *Client, room string) {
+	for _, msg := range s.roomHistory(room) {
+		timestamp := msg.msgDate.Format("2006-01-02 15:04:05")
+		message := fmt.Sprintf("[%v][%s]:%s", timestamp, msg.sender, string(msg.content))
+		evType := EventMessage
+		if msg.topic {
+			message = fmt.Sprintf("[%v]%s", timestamp, topicLine(msg))
+			evType = EventTopic
+		}
+		s.sendEvent(client, []byte(message), Event{
+			Type:    evType,
+			ID:      msg.id,
+			Room:    msg.room,
+			From:    msg.sender,
+			Text:    strings.TrimRight(string(msg.content), "\r\n"),
+			History: true,
+			Time:    msg.msgDate,
+		})
+	}
+}
+
+const (
+	defaultHistoryPage = 20
+	maxHistoryPage     = 200
+)
+
+// historyQuery describes which messages a /history request asks for.
+type historyQuery struct {
+	limit  int
+	before time.Time // only messages strictly before this, if set
+	after  time.Time // only messages strictly after this, if set
+}
+
+// historyTimeLayouts are the timestamp formats accepted by --before and --after.
+// Fractions of a second are accepted after the seconds of any of them.
+var historyTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// parseHistoryTime parses a /history timestamp in the server's local time zone.
+func parseHistoryTime(value string) (time.Time, error) {
+	for _, layout := range historyTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q, use YYYY-MM-DD or YYYY-MM-DD HH:MM:SS", value)
+}
+
+// parseHistoryArgs parses the arguments of "/history [N] [--before timestamp] [--after timestamp]".
+// A timestamp may be given as a date followed by a separate time of day.
+func parseHistoryArgs(args []string) (historyQuery, error) {
+	q := historyQuery{limit: defaultHistoryPage}
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "--before", "--after":
+			if i+1 >= len(args) {
+				return q, fmt.Errorf("%s needs a timestamp", arg)
+			}
+			value := args[i+1]
+			i++
+			if i+1 < len(args) && strings.Count(args[i+1], ":") == 2 && !strings.HasPrefix(args[i+1], "-") {
+				value += " " + args[i+1]
+				i++
+			}
+			t, err := parseHistoryTime(value)
+			if err != nil {
+				return q, err
+			}
+			if arg == "--before" {
+				q.before = t
+			} else {
+				q.after = t
+			}
+		default:
+			if !Check(arg) {
+				return q, fmt.Errorf("unexpected argument %q", arg)
+			}
+			n, _ := strconv.Atoi(arg)
+			if n < 1 || n > maxHistoryPage {
+				return q, fmt.Errorf("N must be between 1 and %d", maxHistoryPage)
+			}
+			q.limit = n
+		}
+	}
+	return q, nil
+}
+
+// queryHistory returns the newest q.limit messages within the query's time range,
+// oldest first, and whether older matching messages were left out.
+func queryHistory(msgs []Message, q historyQuery) (page []Message, more bool) {
+	for _, msg := range msgs {
+		if !q.before.IsZero() && !msg.msgDate.Before(q.before) {
+			continue
+		}
+		if !q.after.IsZero() && !msg.msgDate.After(q.after) {
+			continue
+		}
+		page = append(page, msg)
+	}
+	if len(page) > q.limit {
+		return page[len(page)-q.limit:], true
+	}
+	return page, false
+}
+
+// showHistory answers a /history command with a page of the client's current room history.
+func (s *Server) showHistory(client *Client, args []string) {
+	q, err := parseHistoryArgs(args)
+	if err != nil {
+		s.sendError(client, fmt.Sprintf("%v\nUsage: /history [N] [--before timestamp] [--after timestamp]\n", err))
+		return
+	}
+
+	s.mu.RLock()
+	room := client.room
+	s.mu.RUnlock()
+	if room == "" {
+		s.sendError(client, "You are not in a room. Use /join [room-name] first.\n")
+		return
+	}
+
+	page, more := queryHistory(s.roomHistory(room), q)
+	if len(page) == 0 {
+		s.send(client, []byte(fmt.Sprintf("No history in %s for that range.\n", room)))
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nHistory of %s:\n", room)
+	for _, msg := range page {
+		if msg.topic {
+			fmt.Fprintf(&b, "[%v]%s", msg.msgDate.Format("2006-01-02 15:04:05"), topicLine(msg))
+			continue
+		}
+		fmt.Fprintf(&b, "[%v][%s]:%s", msg.msgDate.Format("2006-01-02 15:04:05"), msg.sender, msg.content)
+	}
+	if more {
+		// to the nanosecond, or messages sent in the same second as page[0] could never be reached
+		fmt.Fprintf(&b, "Older messages: /history %d --before %s", q.limit, page[0].msgDate.Format(time.RFC3339Nano))
+		if !q.after.IsZero() {
+			fmt.Fprintf(&b, " --after %s", q.after.Format(time.RFC3339Nano))
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	s.send(client, []byte(b.String()))
+}
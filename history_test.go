@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_trimHistory(t *testing.T) {
+	now := time.Now()
+	msgs := []Message{
+		{sender: "a", msgDate: now.Add(-3 * time.Hour)},
+		{sender: "b", msgDate: now.Add(-2 * time.Hour)},
+		{sender: "c", msgDate: now.Add(-time.Minute)},
+		{sender: "d", msgDate: now},
+	}
+	tests := []struct {
+		name   string
+		limit  int
+		maxAge time.Duration
+		want   string
+	}{
+		{name: "No limits", want: "abcd"},
+		{name: "Size limit", limit: 3, want: "bcd"},
+		{name: "Age limit", maxAge: 90 * time.Minute, want: "cd"},
+		{name: "Both limits", limit: 1, maxAge: 90 * time.Minute, want: "d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{config: Config{HistoryLimit: tt.limit, HistoryMaxAge: tt.maxAge}}
+			var got string
+			for _, msg := range s.trimHistory(msgs, now) {
+				got += msg.sender
+			}
+			if got != tt.want {
+				t.Errorf("trimHistory() kept %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_historyReplayedPerRoom(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/join secret")
+	alice.waitFor(t, "You have joined: secret")
+	alice.send("for secret eyes only")
+	alice.waitFor(t, "[alice]:for secret eyes only")
+	alice.send("/join lobby")
+	alice.waitFor(t, "You have joined: lobby")
+	alice.send("hello lobby")
+	alice.waitFor(t, "[alice]:hello lobby")
+
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	bob.send("/join lobby")
+	bob.waitFor(t, "[alice]:hello lobby")
+
+	bob.mu.Lock()
+	leaked := strings.Contains(bob.out.String(), "secret eyes")
+	bob.mu.Unlock()
+	if leaked {
+		t.Error("bob was replayed history from a room bob never joined")
+	}
+
+	bob.send("/join secret")
+	bob.waitFor(t, "[alice]:for secret eyes only")
+
+	alice.send("/quit")
+	bob.send("/quit")
+	wg.Wait()
+}
+
+func TestParseHistoryArgs(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name    string
+		args    string
+		want    historyQuery
+		wantErr bool
+	}{
+		{name: "Defaults", args: "", want: historyQuery{limit: defaultHistoryPage}},
+		{name: "Count", args: "5", want: historyQuery{limit: 5}},
+		{name: "Before date", args: "--before 2024-03-01", want: historyQuery{limit: defaultHistoryPage, before: day}},
+		{
+			name: "Range with times",
+			args: "10 --after 2024-03-01 08:30:00 --before 2024-03-01T09:00:00",
+			want: historyQuery{limit: 10, after: day.Add(8*time.Hour + 30*time.Minute), before: day.Add(9 * time.Hour)},
+		},
+		{name: "Zero count", args: "0", wantErr: true},
+		{name: "Missing timestamp", args: "--after", wantErr: true},
+		{name: "Bad timestamp", args: "--before yesterday", wantErr: true},
+		{name: "Unknown argument", args: "everything", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHistoryArgs(strings.Fields(tt.args))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHistoryArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.limit != tt.want.limit || !got.before.Equal(tt.want.before) || !got.after.Equal(tt.want.after)) {
+				t.Errorf("parseHistoryArgs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryHistory(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.Local)
+	var msgs []Message
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, Message{sender: string(rune('a' + i)), msgDate: start.Add(time.Duration(i) * time.Minute)})
+	}
+	tests := []struct {
+		name     string
+		q        historyQuery
+		want     string
+		wantMore bool
+	}{
+		{name: "Newest page", q: historyQuery{limit: 3}, want: "hij", wantMore: true},
+		{name: "Everything", q: historyQuery{limit: 20}, want: "abcdefghij"},
+		{name: "Before", q: historyQuery{limit: 3, before: start.Add(5 * time.Minute)}, want: "cde", wantMore: true},
+		{name: "After", q: historyQuery{limit: 20, after: start.Add(7 * time.Minute)}, want: "ij"},
+		{name: "Range", q: historyQuery{limit: 20, after: start.Add(time.Minute), before: start.Add(4 * time.Minute)}, want: "cd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, more := queryHistory(msgs, tt.q)
+			var got string
+			for _, msg := range page {
+				got += msg.sender
+			}
+			if got != tt.want || more != tt.wantMore {
+				t.Errorf("queryHistory() = %q, %v, want %q, %v", got, more, tt.want, tt.wantMore)
+			}
+		})
+	}
+}
+
+func TestServer_historyPagesWithinASecond(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	second := time.Now().Truncate(time.Second)
+	s.mu.Lock()
+	for i, text := range []string{"first", "second", "third"} {
+		s.history["room1_:0"] = append(s.history["room1_:0"], Message{
+			sender:  "bob",
+			content: []byte(text + "\n"),
+			room:    "room1_:0",
+			msgDate: second.Add(time.Duration(i+1) * time.Millisecond),
+		})
+	}
+	s.mu.Unlock()
+
+	after := second.Format(time.RFC3339Nano)
+	alice.send("/history 1 --after " + after)
+	alice.waitFor(t, "[bob]:third\nOlder messages: /history 1 --before ")
+	alice.mu.Lock()
+	out := alice.out.String()
+	alice.mu.Unlock()
+	hint := out[strings.LastIndex(out, "/history 1 --before "):]
+	hint = hint[:strings.Index(hint, "\n")]
+	if !strings.HasSuffix(hint, " --after "+after) {
+		t.Errorf("hint %q dropped --after", hint)
+	}
+
+	alice.send(hint)
+	alice.waitFor(t, "[bob]:second\n")
+
+	alice.send("/quit")
+	wg.Wait()
+}
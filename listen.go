@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ListenSpec describes one address the server accepts connections on.
+type ListenSpec struct {
+	Network string // "tcp" or "unix"
+	Address string // host:port for tcp, a socket path for unix
+	TLS     bool   // serve TLS with the configured certificate
+}
+
+// String returns the command line spelling of the listener.
+func (ls ListenSpec) String() string {
+	switch {
+	case ls.Network == "unix":
+		return "unix:" + ls.Address
+	case ls.TLS:
+		return "tls:" + ls.Address
+	}
+	return ls.Address
+}
+
+// ParseListenSpec converts a command line value into a ListenSpec. Values are
+// "host:port" or "tcp:host:port" for plain TCP, "tls:host:port" for TLS, and
+// "unix:path" for a Unix domain socket. IPv6 hosts go in brackets, as in "[::1]:8989".
+func ParseListenSpec(value string) (ListenSpec, error) {
+	spec := ListenSpec{Network: "tcp", Address: value}
+	switch {
+	case strings.HasPrefix(value, "unix:"):
+		spec = ListenSpec{Network: "unix", Address: strings.TrimPrefix(value, "unix:")}
+		if spec.Address == "" {
+			return spec, fmt.Errorf("listener %q has no socket path", value)
+		}
+		return spec, nil
+	case strings.HasPrefix(value, "tls:"):
+		spec = ListenSpec{Network: "tcp", Address: strings.TrimPrefix(value, "tls:"), TLS: true}
+	case strings.HasPrefix(value, "tcp:"):
+		spec.Address = strings.TrimPrefix(value, "tcp:")
+	}
+	if _, _, err := net.SplitHostPort(spec.Address); err != nil {
+		return spec, fmt.Errorf("listener %q: %v", value, err)
+	}
+	return spec, nil
+}
+
+// listenSpecs returns every address the server should listen on. Without any
+// configured listeners, it listens on its own address alone, over TLS if a
+// certificate is configured.
+func (s *Server) listenSpecs() []ListenSpec {
+	if len(s.config.Listen) > 0 {
+		return s.config.Listen
+	}
+	return []ListenSpec{{Network: "tcp", Address: s.listenAddr, TLS: s.tls != nil}}
+}
+
+// listen opens a listener for spec, wrapping it in TLS if spec asks for it.
+func (s *Server) listen(spec ListenSpec) (net.Listener, error) {
+	if spec.Network == "unix" {
+		if err := removeStaleSocket(spec.Address); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(spec.Network, spec.Address)
+	if err != nil {
+		return nil, err
+	}
+	if spec.TLS {
+		if s.tls == nil {
+			ln.Close()
+			return nil, fmt.Errorf("listener %s needs a TLS certificate", spec)
+		}
+		ln = tls.NewListener(ln, s.tls)
+	}
+	return ln, nil
+}
+
+// listenAll opens every configured listener, closing those already open if one fails.
+func (s *Server) listenAll() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, spec := range s.listenSpecs() {
+		ln, err := s.listen(spec)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// removeStaleSocket deletes a Unix socket left behind by a server that did
+// not shut down cleanly. A socket something is still listening on is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer runs s until the test ends and returns the address of its first listener.
+func startTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+	listeners, err := s.listenAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listeners = listeners
+	go s.dispatchMessages()
+	for _, ln := range listeners {
+		go s.handleConnection(ln)
+	}
+	t.Cleanup(func() {
+		close(s.shutdown)
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	})
+	return listeners[0].Addr().String()
+}
+
+// readUntil reads from r until want has been seen, failing the test after a few seconds.
+func readUntil(t *testing.T, conn net.Conn, r *bufio.Reader, want string) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var got strings.Builder
+	for !strings.Contains(got.String(), want) {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v (got %q)", want, err, got.String())
+		}
+		got.WriteByte(b)
+	}
+	return got.String()
+}
+
+func TestParseListenSpec(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    ListenSpec
+		wantErr bool
+	}{
+		{value: ":8989", want: ListenSpec{Network: "tcp", Address: ":8989"}},
+		{value: "tcp:127.0.0.1:9000", want: ListenSpec{Network: "tcp", Address: "127.0.0.1:9000"}},
+		{value: "[::1]:8989", want: ListenSpec{Network: "tcp", Address: "[::1]:8989"}},
+		{value: "tls:0.0.0.0:8443", want: ListenSpec{Network: "tcp", Address: "0.0.0.0:8443", TLS: true}},
+		{value: "unix:/run/chat.sock", want: ListenSpec{Network: "unix", Address: "/run/chat.sock"}},
+		{value: "unix:", wantErr: true},
+		{value: "8989", wantErr: true},
+		{value: "::1:8989", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseListenSpec(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseListenSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseListenSpec() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// dialAndLogin connects to ln's address as userName and waits for the welcome.
+func dialAndLogin(t *testing.T, ln net.Listener, userName string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	readUntil(t, conn, r, "[ENTER YOUR NAME]: ")
+	conn.Write([]byte(userName + "\n"))
+	readUntil(t, conn, r, "Welcome, "+userName+"!")
+	return conn, r
+}
+
+func TestServer_multipleListeners(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.Listen = []ListenSpec{
+		{Network: "tcp", Address: "127.0.0.1:0"},
+		{Network: "unix", Address: filepath.Join(t.TempDir(), "chat.sock")},
+	}
+	if ln, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		ln.Close()
+		cfg.Listen = append(cfg.Listen, ListenSpec{Network: "tcp", Address: "[::1]:0"})
+	}
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestServer(t, s)
+
+	names := []string{"alice", "bob", "carol"}
+	conns := make([]net.Conn, len(s.listeners))
+	readers := make([]*bufio.Reader, len(s.listeners))
+	for i, ln := range s.listeners {
+		conns[i], readers[i] = dialAndLogin(t, ln, names[i])
+	}
+
+	conns[0].Write([]byte("hello from tcp\n"))
+	for i := 1; i < len(conns); i++ {
+		readUntil(t, conns[i], readers[i], "[alice]:hello from tcp")
+	}
+	// /rooms marks where the /users listing ends
+	conns[1].Write([]byte("/users\n/rooms\n"))
+	got := readUntil(t, conns[1], readers[1], "available rooms")
+	for _, name := range names[:len(conns)] {
+		if !strings.Contains(got, name+"\n") {
+			t.Errorf("/users over the Unix socket = %q, want %s listed", got, name)
+		}
+	}
+	for _, conn := range conns {
+		conn.Write([]byte("/quit\n"))
+	}
+}
+
+func TestServer_listenStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.sock")
+	old, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+
+	// a live socket is not taken over
+	if _, err := s.listen(ListenSpec{Network: "unix", Address: path}); err == nil {
+		t.Fatal("listened on a socket already in use")
+	}
+
+	// a crashed server leaves its socket file behind
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+	ln, err := s.listen(ListenSpec{Network: "unix", Address: path})
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	ln.Close()
+
+	if _, err := s.listen(ListenSpec{Network: "tcp", Address: "127.0.0.1:0", TLS: true}); err == nil {
+		t.Error("TLS listener without a certificate was opened")
+	}
+}
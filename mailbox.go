@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// forgetNamesAfter is how long a name is remembered, with any mail waiting for
+// it, after it was last used.
+const forgetNamesAfter = 30 * 24 * time.Hour
+
+// mailbox holds direct messages for users who are not connected.
+type mailbox struct {
+	mu    sync.Mutex
+	limit int                  // most messages queued per recipient
+	known map[string]time.Time // names that can receive mail, and when each was last used
+	mail  map[string][]Message // queued messages keyed by recipient, oldest first
+}
+
+// newMailbox creates an empty mailbox holding at most limit messages per recipient.
+func newMailbox(limit int) *mailbox {
+	return &mailbox{
+		limit: limit,
+		known: make(map[string]time.Time),
+		mail:  make(map[string][]Message),
+	}
+}
+
+// remember records that userName is a real user who can receive mail, and
+// forgets the names nobody has used for forgetNamesAfter.
+func (mb *mailbox) remember(userName string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	now := time.Now()
+	for name, seen := range mb.known {
+		if now.Sub(seen) > forgetNamesAfter {
+			delete(mb.known, name)
+			delete(mb.mail, name)
+		}
+	}
+	mb.known[userName] = now
+}
+
+// errUnknownUser and errMailboxFull are returned by put.
+var (
+	errUnknownUser = errors.New("unknown user")
+	errMailboxFull = errors.New("mailbox full")
+)
+
+// put queues msg for userName.
+func (mb *mailbox) put(userName string, msg Message) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if _, ok := mb.known[userName]; !ok {
+		return errUnknownUser
+	}
+	if len(mb.mail[userName]) >= mb.limit {
+		return errMailboxFull
+	}
+	mb.mail[userName] = append(mb.mail[userName], msg)
+	return nil
+}
+
+// take removes and returns everything queued for userName.
+func (mb *mailbox) take(userName string) []Message {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	msgs := mb.mail[userName]
+	delete(mb.mail, userName)
+	return msgs
+}
+
+// rememberMailbox lets userName receive mail while offline. When names can be
+// registered, only registered names and names kept for SSH keys or certificates
+// can, so nobody reads someone else's mail by logging in with a free name.
+func (s *Server) rememberMailbox(userName string) {
+	if s.accounts != nil && !s.accounts.registered(userName) && !s.verifiedOnly(userName) {
+		return
+	}
+	s.mailbox.remember(userName)
+}
+
+// queueDM stores a direct message from client for an offline user and tells the sender what happened.
+func (s *Server) queueDM(client *Client, from, to, text string) {
+	msg := Message{id: s.newMessageID(), sender: from, content: []byte(text), msgDate: time.Now()}
+	switch err := s.mailbox.put(to, msg); err {
+	case nil:
+		s.send(client, []byte(fmt.Sprintf("%s is offline. Your message will be delivered when they log in.\n", to)))
+		LogDM(fmt.Sprintf("[%s][%s -> %s (queued)]:%s\n", msg.msgDate.Format("2006-01-02 15:04:05"), from, to, text))
+	case errMailboxFull:
+		s.sendError(client, fmt.Sprintf("%s is offline and their mailbox is full.\n", to))
+	default:
+		s.sendError(client, fmt.Sprintf("%s is not online.\n", to))
+	}
+}
+
+// deliverMail sends client everything queued for them while they were offline, with the original timestamps.
+func (s *Server) deliverMail(client *Client) {
+	s.mu.RLock()
+	userName := client.userName
+	s.mu.RUnlock()
+
+	msgs := s.mailbox.take(userName)
+	if len(msgs) == 0 {
+		return
+	}
+
+	s.send(client, []byte(fmt.Sprintf("\nYou have %d message(s) from while you were away:\n", len(msgs))))
+	for _, msg := range msgs {
+		timestamp := msg.msgDate.Format("2006-01-02 15:04:05")
+		ev := Event{Type: EventDM, ID: msg.id, From: msg.sender, To: userName, Text: string(msg.content), Time: msg.msgDate}
+		s.sendEvent(client, []byte(fmt.Sprintf("\033[35m[%s][DM from %s]:\033[0m %s\n", timestamp, msg.sender, msg.content)), ev)
+	}
+
+	s.mu.Lock()
+	client.lastDM = msgs[len(msgs)-1].sender
+	s.mu.Unlock()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMailbox_put(t *testing.T) {
+	mb := newMailbox(2)
+	mb.remember("bob")
+
+	msg := Message{sender: "alice", content: []byte("hi"), msgDate: time.Now()}
+	if err := mb.put("dave", msg); err != errUnknownUser {
+		t.Errorf("put() to unknown user error = %v, want %v", err, errUnknownUser)
+	}
+	for i := 0; i < 2; i++ {
+		if err := mb.put("bob", msg); err != nil {
+			t.Fatalf("put() error = %v", err)
+		}
+	}
+	if err := mb.put("bob", msg); err != errMailboxFull {
+		t.Errorf("put() past the cap error = %v, want %v", err, errMailboxFull)
+	}
+	if got := mb.take("bob"); len(got) != 2 {
+		t.Errorf("take() returned %d messages, want 2", len(got))
+	}
+	if got := mb.take("bob"); len(got) != 0 {
+		t.Errorf("take() after emptying returned %d messages", len(got))
+	}
+}
+
+func TestServer_offlineMailDeliveredOnLogin(t *testing.T) {
+	// without accounts, any name that has logged in gets mail
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.AccountsFile = ""
+	s, _ := NewServerWithConfig(cfg)
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	bob.send("/quit")
+	wg.Wait()
+
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/msg bob call me when you're back")
+	alice.waitFor(t, "bob is offline. Your message will be delivered when they log in.")
+	alice.send("/msg nobody hello")
+	alice.waitFor(t, "nobody is not online.")
+
+	bob = connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "You have 1 message(s) from while you were away:")
+	bob.waitFor(t, "[DM from alice]:\033[0m call me when you're back")
+	bob.send("/r back now")
+	alice.waitFor(t, "[DM from bob]:\033[0m back now")
+
+	alice.send("/quit")
+	bob.send("/quit")
+	wg.Wait()
+}
+
+func TestMailbox_forgetsUnusedNames(t *testing.T) {
+	mb := newMailbox(2)
+	mb.remember("bob")
+	msg := Message{sender: "alice", content: []byte("hi"), msgDate: time.Now()}
+	if err := mb.put("bob", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	mb.known["bob"] = time.Now().Add(-forgetNamesAfter - time.Hour)
+	mb.remember("carol")
+	if err := mb.put("bob", msg); err != errUnknownUser {
+		t.Errorf("put() to a long unused name error = %v, want %v", err, errUnknownUser)
+	}
+	if got := mb.take("bob"); len(got) != 0 {
+		t.Errorf("mail for a forgotten name was kept: %d messages", len(got))
+	}
+}
+
+func TestServer_offlineMailOnlyForRegisteredNames(t *testing.T) {
+	s := newAccessTestServer(t)
+
+	var wg sync.WaitGroup
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	bob.send("/quit")
+	carol := connectTestClient(t, s, &wg, "carol")
+	carol.waitFor(t, "Welcome, carol!")
+	carol.send("/register hunter22")
+	carol.waitFor(t, "carol is now registered.")
+	carol.send("/quit")
+	wg.Wait()
+
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/msg bob anyone could log in as you")
+	alice.waitFor(t, "bob is not online.")
+	alice.send("/msg carol only you can read this")
+	alice.waitFor(t, "carol is offline. Your message will be delivered when they log in.")
+
+	carol = connectTestClient(t, s, &wg, "carol")
+	carol.waitFor(t, "[ENTER PASSWORD]: ")
+	carol.send("hunter22")
+	carol.waitFor(t, "[DM from alice]:\033[0m only you can read this")
+
+	alice.send("/quit")
+	carol.send("/quit")
+	wg.Wait()
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// roomState is what the server remembers about a room besides its members.
+// It is guarded by Server.mu and outlives the room while it has a topic, a key or
+// invitations, or anyone is banned or muted in it.
+type roomState struct {
+	operators   map[*Client]bool     // members allowed to moderate the room
+	bannedNames map[string]string    // user names refused by /join, each to the name banned, which /unban lifts
+	bannedIPs   map[string]bool      // addresses refused by /join
+	muted       map[string]time.Time // user names that may not chat, and when that ends; zero for never
+	topic       roomTopic            // shown on joining and by /topic
+	creator     string               // who opened the room, the only one who may change its modes
+	key         string               // what /join must give, if not empty
+	inviteOnly  bool                 // only invited users may join
+	invited     map[string]bool      // user names let in whatever the room's key or modes
+}
+
+// roomState returns the state of room, creating it if needed. The caller must hold s.mu for writing.
+func (s *Server) roomState(room string) *roomState {
+	rs, ok := s.roomInfo[room]
+	if !ok {
+		rs = &roomState{
+			operators:   make(map[*Client]bool),
+			bannedNames: make(map[string]string),
+			bannedIPs:   make(map[string]bool),
+			muted:       make(map[string]time.Time),
+			invited:     make(map[string]bool),
+		}
+		s.roomInfo[room] = rs
+	}
+	return rs
+}
+
+// forgetRoom drops the state of a room nobody is in any more, unless it still has
+// a topic, or a key, invitations, bans or mutes to enforce.
+// The caller must hold s.mu for writing.
+func (s *Server) forgetRoom(room string) {
+	rs, ok := s.roomInfo[room]
+	if !ok {
+		return
+	}
+	clear(rs.operators)
+	now := time.Now()
+	for name, until := range rs.muted {
+		if !until.IsZero() && now.After(until) {
+			delete(rs.muted, name)
+		}
+	}
+	private := rs.key != "" || rs.inviteOnly || len(rs.invited) > 0
+	if rs.topic.text == "" && !private && len(rs.bannedNames) == 0 && len(rs.bannedIPs) == 0 && len(rs.muted) == 0 {
+		delete(s.roomInfo, room)
+	}
+}
+
+// isAdmin reports whether client is one of the configured admins. Admins must
+// have proved their name with a password, certificate or SSH key, since anyone
+// could otherwise pick one. The caller must hold s.mu.
+func (s *Server) isAdmin(client *Client) bool {
+	return slices.Contains(s.config.Admins, client.userName) && provedName(client)
+}
+
+// provedName reports whether client proved its name with a password, certificate
+// or SSH key, so that nobody else can use the name to act as them. The caller must hold s.mu.
+func provedName(client *Client) bool {
+	return client.account == client.userName || client.verifiedBy != ""
+}
+
+// isOperator reports whether client may moderate room. The caller must hold s.mu.
+func (s *Server) isOperator(client *Client, room string) bool {
+	if !s.config.Moderation {
+		return false
+	}
+	if s.isAdmin(client) {
+		return true
+	}
+	rs, ok := s.roomInfo[room]
+	return ok && rs.operators[client]
+}
+
+// clientIP returns the IP address client connected from, or "" if it has none, as on a Unix socket.
+func clientIP(client *Client) string {
+	return addrIP(client.conn.RemoteAddr())
+}
+
+// addrIP returns the IP address of addr in canonical form, or "" if it has none.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return net.ParseIP(host).String()
+}
+
+// joinRefusal explains why client may not join room, or returns "" if it may. The caller must hold s.mu.
+func (s *Server) joinRefusal(client *Client, room string) string {
+	rs, ok := s.roomInfo[room]
+	if !ok || s.isAdmin(client) {
+		return ""
+	}
+	_, nameBanned := rs.bannedNames[client.userName]
+	_, accountBanned := rs.bannedNames[client.account]
+	if nameBanned || client.account != "" && accountBanned {
+		return fmt.Sprintf("You are banned from %s.\n", room)
+	}
+	if ip := clientIP(client); ip != "" && rs.bannedIPs[ip] {
+		return fmt.Sprintf("Your address is banned from %s.\n", room)
+	}
+	return ""
+}
+
+// muteRemaining reports whether client is muted in room and for how much longer,
+// 0 meaning until an operator unmutes them. The caller must hold s.mu.
+func (s *Server) muteRemaining(client *Client, room string) (time.Duration, bool) {
+	rs, ok := s.roomInfo[room]
+	if !ok {
+		return 0, false
+	}
+	until, muted := rs.muted[client.userName]
+	if !muted {
+		return 0, false
+	}
+	if until.IsZero() {
+		return 0, true
+	}
+	left := time.Until(until)
+	return left, left > 0
+}
+
+// renameRoomState carries bans, mutes and invitations over when a user changes
+// name, so /name is no way out of a ban or mute; a ban keeps the old name too.
+// The rooms a user created stay with the registered name that proves it is them.
+// The caller must hold s.mu for writing.
+func (s *Server) renameRoomState(oldName, newName string) {
+	for _, rs := range s.roomInfo {
+		if ban, ok := rs.bannedNames[oldName]; ok {
+			rs.bannedNames[newName] = ban
+		}
+		if until, ok := rs.muted[oldName]; ok {
+			delete(rs.muted, oldName)
+			rs.muted[newName] = until
+		}
+		if rs.invited[oldName] {
+			delete(rs.invited, oldName)
+			rs.invited[newName] = true
+		}
+	}
+}
+
+// moderator checks that client is an operator of the room it is in, and returns
+// the room and client's name. Otherwise it tells client why not.
+func (s *Server) moderator(client *Client) (room, actor string, ok bool) {
+	s.mu.RLock()
+	room, actor = client.room, client.userName
+	allowed := s.isOperator(client, room)
+	s.mu.RUnlock()
+
+	switch {
+	case room == "":
+		s.sendError(client, "You are not in a room. Use /join [room-name] first.\n")
+	case !allowed:
+		s.sendError(client, fmt.Sprintf("You are not an operator of %s.\n", room))
+	default:
+		return room, actor, true
+	}
+	return "", "", false
+}
+
+// roomMember returns the member of room called userName, or nil if nobody by that name is in it.
+// The caller must hold s.mu.
+func (s *Server) roomMember(room, userName string) *Client {
+	for _, c := range s.rooms[room] {
+		if c.userName == userName {
+			return c
+		}
+	}
+	return nil
+}
+
+// moderationTarget finds the member of room a command is aimed at, telling
+// client if there is nobody by that name or they are an admin.
+func (s *Server) moderationTarget(client *Client, room, userName string) *Client {
+	s.mu.RLock()
+	target := s.roomMember(room, userName)
+	protected := target != nil && target != client && s.isAdmin(target)
+	s.mu.RUnlock()
+
+	switch {
+	case target == nil:
+		s.sendError(client, fmt.Sprintf("%s is not in %s.\n", userName, room))
+	case protected:
+		s.sendError(client, fmt.Sprintf("%s is a server admin.\n", userName))
+	default:
+		return target
+	}
+	return nil
+}
+
+// notifyRoom sends ev to every member of room.
+func (s *Server) notifyRoom(room string, msg []byte, ev Event) {
+	s.mu.RLock()
+	members := s.rooms[room]
+	s.mu.RUnlock()
+
+	message := fmt.Sprintf("\r%s\n", msg)
+	s.Logs(message)
+	for _, c := range members {
+		s.sendEvent(c, []byte(message), ev)
+	}
+}
+
+// eject removes target from room on an operator's say and tells target why.
+// It reports false if target had already left.
+func (s *Server) eject(target *Client, room, notice string, ev Event) bool {
+	if !s.removeMember(target, room) {
+		return false
+	}
+	s.sendEvent(target, []byte(notice), ev)
+	s.runLeaveHooks(target, room)
+	return true
+}
+
+// setOperator handles "/op <user>" and "/deop <user>".
+func (s *Server) setOperator(client *Client, userName string, op bool) {
+	room, actor, ok := s.moderator(client)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	target := s.roomMember(room, userName)
+	if target == nil {
+		s.mu.Unlock()
+		s.sendError(client, fmt.Sprintf("%s is not in %s.\n", userName, room))
+		return
+	}
+	if op {
+		s.roomState(room).operators[target] = true
+	} else {
+		delete(s.roomState(room).operators, target)
+	}
+	s.mu.Unlock()
+
+	ev := Event{Type: EventOp, Room: room, From: actor, To: userName}
+	message := fmt.Sprintf("%s made %s an operator of %s", actor, userName, room)
+	if !op {
+		ev.Type = EventDeop
+		message = fmt.Sprintf("%s removed %s as an operator of %s", actor, userName, room)
+	}
+	s.notifyRoom(room, []byte(message), ev)
+}
+
+// kickUser handles "/kick <user> [reason]".
+func (s *Server) kickUser(client *Client, args []string) {
+	room, actor, ok := s.moderator(client)
+	if !ok {
+		return
+	}
+	target := s.moderationTarget(client, room, args[0])
+	if target == nil {
+		return
+	}
+	reason := ""
+	if len(args) > 1 {
+		reason = args[1]
+	}
+
+	ev := Event{Type: EventKick, Room: room, From: actor, To: args[0], Text: reason}
+	notice := fmt.Sprintf("You were kicked from %s by %s%s\n", room, actor, because(reason))
+	if s.eject(target, room, notice, ev) {
+		s.notifyRoom(room, []byte(fmt.Sprintf("%s was kicked from %s by %s%s", args[0], room, actor, because(reason))), ev)
+	}
+}
+
+// because formats an optional reason to end a sentence with.
+func because(reason string) string {
+	if reason == "" {
+		return "."
+	}
+	return ": " + reason
+}
+
+// banUser handles "/ban <user|ip>", removing anyone it matches from the room and keeping them out.
+func (s *Server) banUser(client *Client, who string) {
+	room, actor, ok := s.moderator(client)
+	if !ok {
+		return
+	}
+
+	ip := net.ParseIP(who)
+	s.mu.Lock()
+	var targets []*Client
+	for _, c := range s.rooms[room] {
+		if c != client && ((ip == nil && c.userName == who) || (ip != nil && clientIP(c) == ip.String())) {
+			targets = append(targets, c)
+		}
+	}
+	protected := false
+	for _, c := range targets {
+		protected = protected || s.isAdmin(c)
+	}
+	if !protected {
+		rs := s.roomState(room)
+		if ip != nil {
+			who = ip.String()
+			rs.bannedIPs[who] = true
+		} else {
+			rs.bannedNames[who] = who
+			// a registered user is banned whatever name they come back under
+			for _, c := range targets {
+				if c.account != "" {
+					rs.bannedNames[c.account] = who
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if protected {
+		s.sendError(client, fmt.Sprintf("%s matches a server admin.\n", who))
+		return
+	}
+	ev := Event{Type: EventBan, Room: room, From: actor, To: who}
+	for _, target := range targets {
+		s.eject(target, room, fmt.Sprintf("You were banned from %s by %s.\n", room, actor), ev)
+	}
+	s.notifyRoom(room, []byte(fmt.Sprintf("%s was banned from %s by %s", who, room, actor)), ev)
+}
+
+// unbanUser handles "/unban <user|ip>".
+func (s *Server) unbanUser(client *Client, who string) {
+	room, actor, ok := s.moderator(client)
+	if !ok {
+		return
+	}
+	if ip := net.ParseIP(who); ip != nil {
+		who = ip.String()
+	}
+
+	s.mu.Lock()
+	rs := s.roomState(room)
+	ban, banned := rs.bannedNames[who]
+	banned = banned || rs.bannedIPs[who]
+	for name, b := range rs.bannedNames {
+		if name == who || b == ban {
+			delete(rs.bannedNames, name)
+		}
+	}
+	delete(rs.bannedIPs, who)
+	s.mu.Unlock()
+
+	if !banned {
+		s.sendError(client, fmt.Sprintf("%s is not banned from %s.\n", who, room))
+		return
+	}
+	ev := Event{Type: EventUnban, Room: room, From: actor, To: who}
+	s.notifyRoom(room, []byte(fmt.Sprintf("%s lifted the ban on %s", actor, who)), ev)
+}
+
+// muteUser handles "/mute <user> [duration]". Without a duration the mute lasts until /unmute.
+func (s *Server) muteUser(client *Client, args []string) {
+	room, actor, ok := s.moderator(client)
+	if !ok {
+		return
+	}
+	var length time.Duration
+	if len(args) > 1 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			s.sendError(client, fmt.Sprintf("Invalid duration %q, use something like 30s or 10m.\n", args[1]))
+			return
+		}
+		length = d
+	}
+	if s.moderationTarget(client, room, args[0]) == nil {
+		return
+	}
+
+	var until time.Time
+	if length > 0 {
+		until = time.Now().Add(length)
+	}
+	s.mu.Lock()
+	s.roomState(room).muted[args[0]] = until
+	s.mu.Unlock()
+
+	ev := Event{Type: EventMute, Room: room, From: actor, To: args[0]}
+	message := fmt.Sprintf("%s muted %s", actor, args[0])
+	if length > 0 {
+		ev.Text = length.String()
+		message += " for " + length.String()
+	}
+	s.notifyRoom(room, []byte(message), ev)
+}
+
+// unmuteUser handles "/unmute <user>".
+func (s *Server) unmuteUser(client *Client, userName string) {
+	room, actor, ok := s.moderator(client)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	rs := s.roomState(room)
+	_, muted := rs.muted[userName]
+	delete(rs.muted, userName)
+	s.mu.Unlock()
+
+	if !muted {
+		s.sendError(client, fmt.Sprintf("%s is not muted in %s.\n", userName, room))
+		return
+	}
+	ev := Event{Type: EventUnmute, Room: room, From: actor, To: userName}
+	s.notifyRoom(room, []byte(fmt.Sprintf("%s unmuted %s", actor, userName)), ev)
+}
+
+// registerModeration adds the operator commands.
+func (s *Server) registerModeration() {
+	s.addCommand(&command{
+		name: "/op", args: "<user>", help: "Make someone in your room an operator",
+		minArgs: 1, maxArgs: 1,
+		run: func(client *Client, args []string) { s.setOperator(client, args[0], true) },
+	})
+	s.addCommand(&command{
+		name: "/deop", args: "<user>", help: "Take away someone's operator rights",
+		minArgs: 1, maxArgs: 1,
+		run: func(client *Client, args []string) { s.setOperator(client, args[0], false) },
+	})
+	s.addCommand(&command{
+		name: "/kick", args: "<user> [reason]", help: "Remove someone from your room",
+		minArgs: 1, maxArgs: 2, rest: true,
+		run: s.kickUser,
+	})
+	s.addCommand(&command{
+		name: "/ban", args: "<user|ip>", help: "Remove someone from your room and keep them out",
+		minArgs: 1, maxArgs: 1,
+		run: func(client *Client, args []string) { s.banUser(client, args[0]) },
+	})
+	s.addCommand(&command{
+		name: "/unban", args: "<user|ip>", help: "Let a banned user or address back in",
+		minArgs: 1, maxArgs: 1,
+		run: func(client *Client, args []string) { s.unbanUser(client, args[0]) },
+	})
+	s.addCommand(&command{
+		name: "/mute", args: "<user> [duration]", help: "Stop someone chatting in your room, for a while or until /unmute",
+		minArgs: 1, maxArgs: 2,
+		run: s.muteUser,
+	})
+	s.addCommand(&command{
+		name: "/unmute", args: "<user>", help: "Let a muted user chat again",
+		minArgs: 1, maxArgs: 1,
+		run: func(client *Client, args []string) { s.unmuteUser(client, args[0]) },
+	})
+}
+
+// describeMute says how long a mute has left, for telling the muted user.
+func describeMute(left time.Duration) string {
+	if left == 0 {
+		return "until an operator unmutes you"
+	}
+	return "for another " + left.Round(time.Second).String()
+}
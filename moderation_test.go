@@ -0,0 +1,191 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestServer_moderation(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "You are an operator of room1_:0.")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	carol := connectTestClient(t, s, &wg, "carol")
+	carol.waitFor(t, "Welcome, carol!")
+
+	bob.send("/kick alice")
+	bob.waitFor(t, "You are not an operator of room1_:0.")
+
+	alice.send("/mute bob 1h")
+	bob.waitFor(t, "alice muted bob for 1h0m0s")
+	bob.send("can you hear me")
+	bob.waitFor(t, "You are muted in room1_:0 for another ")
+	bob.send("/name bobby")
+	bob.waitFor(t, "You are now bobby")
+	bob.send("still?")
+	bob.waitFor(t, "You are muted in room1_:0 for another")
+	alice.send("/unmute bobby")
+	bob.waitFor(t, "alice unmuted bobby")
+	bob.send("thanks")
+	alice.waitFor(t, "[bobby]:thanks")
+
+	alice.send("/op bobby")
+	bob.waitFor(t, "alice made bobby an operator of room1_:0")
+	bob.send("/kick carol stop spamming")
+	carol.waitFor(t, "You were kicked from room1_:0 by bobby: stop spamming")
+	alice.waitFor(t, "carol was kicked from room1_:0 by bobby: stop spamming")
+	carol.send("back")
+	carol.waitFor(t, "You are not in a room.")
+
+	alice.send("/ban carol")
+	bob.waitFor(t, "carol was banned from room1_:0 by alice")
+	carol.send("/join room1_:0")
+	carol.waitFor(t, "You are banned from room1_:0.")
+	alice.send("/unban carol")
+	bob.waitFor(t, "alice lifted the ban on carol")
+	carol.send("/join room1_:0")
+	carol.waitFor(t, "You have joined: room1_:0")
+
+	alice.send("/deop bobby")
+	bob.waitFor(t, "alice removed bobby as an operator of room1_:0")
+	bob.send("/mute carol")
+	bob.waitFor(t, "You are not an operator of room1_:0.")
+
+	for _, tc := range []*testClient{alice, bob, carol} {
+		tc.send("/quit")
+	}
+	wg.Wait()
+}
+
+func TestServer_moderationAdmins(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	cfg.Admins = []string{"alice"}
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "You are an operator of room1_:0.")
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	// the name alone is not enough
+	bob.send("/mute alice")
+	alice.waitFor(t, "bob muted alice")
+	bob.send("/unmute alice")
+	alice.waitFor(t, "bob unmuted alice")
+
+	alice.send("/register hunter22")
+	alice.waitFor(t, "alice is now registered.")
+	bob.send("/kick alice")
+	bob.waitFor(t, "alice is a server admin.")
+	alice.send("/deop bob")
+	bob.waitFor(t, "alice removed bob as an operator of room1_:0")
+	alice.send("/ban bob")
+	bob.waitFor(t, "You were banned from room1_:0 by alice.")
+
+	bob.send("/quit")
+	alice.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_banSurvivesRename(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "You are an operator of room1_:0.")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	bob.send("/register hunter22")
+	bob.waitFor(t, "bob is now registered.")
+	bob.send("/name bobby")
+	bob.waitFor(t, "You are now bobby")
+
+	alice.send("/ban bobby")
+	bob.waitFor(t, "You were banned from room1_:0 by alice.")
+	bob.send("/name robert")
+	bob.waitFor(t, "You are now robert")
+	bob.send("/join room1_:0")
+	bob.waitFor(t, "You are banned from room1_:0.")
+
+	// the ban follows bob's account back to the registered name
+	bob.send("/name bob")
+	bob.waitFor(t, "You are now bob\n")
+	bob.send("/join room1_:0")
+	bob.waitFor(t, "You are now bob\n\nYou are banned from room1_:0.")
+
+	// lifting the ban under any of its names lifts all of them
+	alice.send("/unban robert")
+	alice.waitFor(t, "alice lifted the ban on robert")
+	bob.send("/join room1_:0")
+	bob.waitFor(t, "You have joined: room1_:0")
+
+	bob.send("/quit")
+	alice.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_banAddress(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.HistoryDir = ""
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestServer(t, s)
+	ln := s.listeners[0]
+
+	alice, aliceR := dialAndLogin(t, ln, "alice")
+	bob, bobR := dialAndLogin(t, ln, "bob")
+	alice.Write([]byte("/ban ::ffff:127.0.0.1\n"))
+	readUntil(t, bob, bobR, "You were banned from room1_127.0.0.1:0 by alice.")
+	readUntil(t, alice, aliceR, "127.0.0.1 was banned from room1_127.0.0.1:0 by alice")
+
+	bob.Write([]byte("/join room1_127.0.0.1:0\n"))
+	readUntil(t, bob, bobR, "Your address is banned from room1_127.0.0.1:0.")
+	bob.Write([]byte("/join elsewhere\n"))
+	readUntil(t, bob, bobR, "You have joined: elsewhere")
+}
+
+func TestServer_moderationDisabled(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.Moderation = false
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("/kick bob")
+	alice.waitFor(t, "Unknown command /kick.")
+
+	alice.send("/quit")
+	wg.Wait()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	minNameLen = 3
+	maxNameLen = 20
+
+	// maxNameAttempts is how many times a new connection may pick a name before being dropped.
+	maxNameAttempts = 5
+)
+
+var errNameTaken = errors.New("name already in use")
+
+// validateName checks that name has an allowed length and only letters, digits, '_', '-' and '.'.
+func validateName(name string) error {
+	if len(name) < minNameLen || len(name) > maxNameLen {
+		return fmt.Errorf("names must be %d to %d characters long", minNameLen, maxNameLen)
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+		default:
+			return fmt.Errorf("names may only contain letters, digits, '_', '-' and '.'")
+		}
+	}
+	return nil
+}
+
+// nameRegistry tracks which user names are held by connected clients.
+type nameRegistry struct {
+	mu    sync.Mutex
+	inUse map[string]bool
+}
+
+// newNameRegistry creates an empty registry.
+func newNameRegistry() *nameRegistry {
+	return &nameRegistry{inUse: make(map[string]bool)}
+}
+
+// reserve claims name, failing with errNameTaken if someone already holds it.
+func (nr *nameRegistry) reserve(name string) error {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	if nr.inUse[name] {
+		return errNameTaken
+	}
+	nr.inUse[name] = true
+	return nil
+}
+
+// taken reports whether someone holds name.
+func (nr *nameRegistry) taken(name string) bool {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return nr.inUse[name]
+}
+
+// rename atomically swaps oldName for newName, failing with errNameTaken if newName is held.
+func (nr *nameRegistry) rename(oldName, newName string) error {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	if oldName == newName {
+		return nil
+	}
+	if nr.inUse[newName] {
+		return errNameTaken
+	}
+	delete(nr.inUse, oldName)
+	nr.inUse[newName] = true
+	return nil
+}
+
+// release frees name for others to use.
+func (nr *nameRegistry) release(name string) {
+	nr.mu.Lock()
+	delete(nr.inUse, name)
+	nr.mu.Unlock()
+}
+
+// login prompts until the client picks a valid name nobody else is using, asking
+// for the password of registered names. Clients who proved who they are while
+// connecting are named without a prompt. ok is false if the client should be dropped.
+func (s *Server) login(client *Client) (userName, account string, ok bool) {
+	if name, proof := verifiedName(client.conn); name != "" {
+		return s.loginVerified(client, name, proof)
+	}
+
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		s.sendEvent(client, []byte("[ENTER YOUR NAME]: "), Event{Type: EventPrompt, Field: "name"})
+		line, err := s.readLine(client)
+		if err != nil {
+			return "", "", false
+		}
+
+		userName = strings.TrimSpace(line)
+		if err := validateName(userName); err != nil {
+			s.sendError(client, fmt.Sprintf("Invalid name: %v. Please choose another.\n", err))
+			continue
+		}
+		if s.verifiedOnly(userName) {
+			s.sendError(client, fmt.Sprintf("%s can only log in with its SSH key or client certificate. Please choose another name.\n", userName))
+			continue
+		}
+		if s.names.taken(userName) {
+			s.sendError(client, fmt.Sprintf("%s is already in the chat. Please choose another name.\n", userName))
+			continue
+		}
+
+		// the name is only reserved once its password is right, so nobody can
+		// hold a registered name by sitting at the password prompt
+		registered := s.accounts != nil && s.accounts.registered(userName)
+		if registered && !s.authenticate(client, userName) {
+			s.sendError(client, "Authentication failed. Disconnecting...\n")
+			return "", "", false
+		}
+		if err := s.names.reserve(userName); err != nil {
+			s.sendError(client, fmt.Sprintf("%s is already in the chat. Please choose another name.\n", userName))
+			continue
+		}
+		if registered {
+			account = userName
+		}
+		s.rememberMailbox(userName)
+		return userName, account, true
+	}
+
+	s.sendError(client, "Too many attempts. Disconnecting...\n")
+	return "", "", false
+}
+
+// verifiedName returns the name a connection proved it belongs to before the
+// chat began, and what proved it, or "" if the user has to log in.
+func verifiedName(conn net.Conn) (userName, proof string) {
+	if userName := certificateName(conn); userName != "" {
+		return userName, "client certificate"
+	}
+	if session, ok := conn.(*sshConn); ok {
+		return session.userName, "SSH key"
+	}
+	return "", ""
+}
+
+// verifiedOnly reports whether userName may only be used by whoever proves it
+// is theirs with an SSH key or client certificate: it is listed in VerifiedNames
+// or is the name of an authorized SSH key.
+func (s *Server) verifiedOnly(userName string) bool {
+	if slices.Contains(s.config.VerifiedNames, userName) {
+		return true
+	}
+	if keys := s.sshKeys.Load(); keys != nil {
+		for _, name := range *keys {
+			if name == userName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loginVerified logs client in as the name its certificate or key proves it
+// owns, so registered names need no password.
+func (s *Server) loginVerified(client *Client, userName, proof string) (string, string, bool) {
+	if err := validateName(userName); err != nil {
+		s.sendError(client, fmt.Sprintf("The name %q from your %s is not a valid name: %v. Disconnecting...\n", userName, proof, err))
+		return "", "", false
+	}
+	if err := s.names.reserve(userName); err != nil {
+		s.sendError(client, fmt.Sprintf("%s is already in the chat. Disconnecting...\n", userName))
+		return "", "", false
+	}
+
+	client.verifiedBy = proof
+	account := ""
+	if s.accounts != nil && s.accounts.registered(userName) {
+		account = userName
+	}
+	s.rememberMailbox(userName)
+	return userName, account, true
+}
+
+// changeName handles "/name <new-name>", enforcing the same rules as login.
+func (s *Server) changeName(client *Client, newUserName string) {
+	if client.verifiedBy != "" {
+		s.sendError(client, fmt.Sprintf("Your name comes from your %s and cannot be changed.\n", client.verifiedBy))
+		return
+	}
+	if err := validateName(newUserName); err != nil {
+		s.sendError(client, fmt.Sprintf("Invalid name: %v.\n", err))
+		return
+	}
+	if s.verifiedOnly(newUserName) {
+		s.sendError(client, fmt.Sprintf("%s can only be used with its SSH key or client certificate.\n", newUserName))
+		return
+	}
+	if s.nameTakenByAccount(client, newUserName) {
+		s.sendError(client, fmt.Sprintf("%s is registered to someone else.\n", newUserName))
+		return
+	}
+
+	s.mu.Lock()
+	oldUserName := client.userName
+	s.mu.Unlock()
+	if err := s.names.rename(oldUserName, newUserName); err != nil {
+		s.sendError(client, fmt.Sprintf("%s is already in the chat. Please choose another name.\n", newUserName))
+		return
+	}
+	s.mu.Lock()
+	client.userName = newUserName
+	s.renameRoomState(oldUserName, newUserName)
+	s.mu.Unlock()
+	s.saveModes()
+	s.rememberMailbox(newUserName)
+
+	ev := Event{Type: EventRename, From: oldUserName, To: newUserName}
+	message := []byte(fmt.Sprintf("%s is now %s\n", oldUserName, newUserName))
+	s.notifyOthers(client, message, ev)
+
+	// Confirm the name change to the client who requested it
+	confirmation := fmt.Sprintf("\nSuccess! You are now %s\n\n", newUserName)
+	s.sendEvent(client, []byte(confirmation), ev)
+}
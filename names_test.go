@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		wantErr bool
+	}{
+		{name: "Simple", arg: "alice"},
+		{name: "Allowed punctuation", arg: "j.doe_2-b"},
+		{name: "Too short", arg: "al", wantErr: true},
+		{name: "Too long", arg: "abcdefghijklmnopqrstu", wantErr: true},
+		{name: "Space", arg: "al ice", wantErr: true},
+		{name: "Telnet junk", arg: "ali\xff\xfbce", wantErr: true},
+		{name: "Slash", arg: "/quit", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateName(tt.arg); (err != nil) != tt.wantErr {
+				t.Errorf("validateName(%q) error = %v, wantErr %v", tt.arg, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNameRegistry(t *testing.T) {
+	nr := newNameRegistry()
+	if err := nr.reserve("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nr.reserve("alice"); err != errNameTaken {
+		t.Errorf("reserve() of a held name error = %v, want %v", err, errNameTaken)
+	}
+	if err := nr.reserve("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nr.rename("bob", "alice"); err != errNameTaken {
+		t.Errorf("rename() onto a held name error = %v, want %v", err, errNameTaken)
+	}
+	if err := nr.rename("bob", "robert"); err != nil {
+		t.Errorf("rename() error = %v", err)
+	}
+	if err := nr.reserve("bob"); err != nil {
+		t.Errorf("old name was not freed by rename: %v", err)
+	}
+	nr.release("alice")
+	if err := nr.reserve("alice"); err != nil {
+		t.Errorf("released name could not be reserved: %v", err)
+	}
+}
+
+func TestServer_uniqueNames(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+
+	second := connectTestClient(t, s, &wg, "alice")
+	second.waitFor(t, "alice is already in the chat. Please choose another name.")
+	second.send("x")
+	second.waitFor(t, "Invalid name: names must be 3 to 20 characters long. Please choose another.")
+	second.send("alicia")
+	second.waitFor(t, "Welcome, alicia!")
+
+	bob.send("/name alicia")
+	bob.waitFor(t, "alicia is already in the chat. Please choose another name.")
+	bob.send("/name b@d")
+	bob.waitFor(t, "Invalid name: names may only contain letters")
+
+	alice.send("/quit")
+	alice.waitFor(t, "Exiting the chat...")
+	deadline := time.Now().Add(2 * time.Second)
+	for s.names.reserve("alice") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("alice's name was never released")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.names.release("alice")
+	bob.send("/name alice")
+	bob.waitFor(t, "You are now alice")
+
+	bob.send("/quit")
+	second.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_verifiedNames(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.VerifiedNames = []string{"carol"}
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{"key": "alice"}
+	s.sshKeys.Store(&keys)
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	impostor := connectTestClient(t, s, &wg, "alice")
+	impostor.waitFor(t, "alice can only log in with its SSH key or client certificate. Please choose another name.")
+	impostor.send("carol")
+	impostor.waitFor(t, "carol can only log in with its SSH key or client certificate. Please choose another name.")
+	impostor.send("mallory")
+	impostor.waitFor(t, "Welcome, mallory!")
+	impostor.send("/name alice")
+	impostor.waitFor(t, "alice can only be used with its SSH key or client certificate.")
+
+	impostor.send("/quit")
+	wg.Wait()
+}
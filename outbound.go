@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+)
+
+// flushTimeout bounds how long a departing client's queued messages may take to write.
+const flushTimeout = 2 * time.Second
+
+// newClient creates a client with an empty outbound queue sized from the server config.
+// The client has no name until it logs in.
+func (s *Server) newClient(conn net.Conn, reader *bufio.Reader) *Client {
+	return &Client{
+		server:  s,
+		conn:    conn,
+		reader:  reader,
+		out:     make(chan []byte, s.config.QueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// send queues text output for client. Structured clients receive it as an info event.
+func (s *Server) send(client *Client, msg []byte) {
+	if client.structured {
+		s.enqueue(client, encodeEvent(Event{Type: EventInfo, Text: plainText(msg)}))
+		return
+	}
+	s.enqueue(client, msg)
+}
+
+// trySend queues text output for client like send, but drops it rather than
+// wait when the queue is full, whatever the slow consumer policy.
+func (s *Server) trySend(client *Client, msg []byte) {
+	if client.structured {
+		msg = encodeEvent(Event{Type: EventInfo, Text: plainText(msg)})
+	}
+	select {
+	case client.out <- msg:
+	default:
+		s.countDropped(client)
+	}
+}
+
+// enqueue queues msg for delivery to client, applying the configured slow consumer policy
+// when the client's queue is full. It never blocks unless the policy is Block.
+func (s *Server) enqueue(client *Client, msg []byte) {
+	select {
+	case client.out <- msg:
+		return
+	case <-client.done:
+		return
+	default:
+	}
+
+	switch s.config.SlowPolicy {
+	case Block:
+		select {
+		case client.out <- msg:
+		case <-client.done:
+		case <-client.stopped:
+			// the writer gave up on a broken connection and nothing will make room
+		}
+
+	case Disconnect:
+		s.countDropped(client)
+		now := time.Now().UnixNano()
+		if !client.stalledSince.CompareAndSwap(0, now) {
+			if time.Duration(now-client.stalledSince.Load()) > s.config.SlowTimeout {
+				fmt.Printf("Disconnecting slow client %s\n", client.conn.RemoteAddr())
+				client.conn.Close()
+			}
+		}
+
+	default: // DropOldest
+		for {
+			select {
+			case client.out <- msg:
+				return
+			case <-client.done:
+				return
+			case <-client.out:
+				s.countDropped(client)
+			}
+		}
+	}
+}
+
+// countDropped records a message that was never delivered to client.
+func (s *Server) countDropped(client *Client) {
+	client.dropped.Add(1)
+	s.dropped.Add(1)
+}
+
+// DroppedMessages reports how many messages have been discarded for slow clients.
+func (s *Server) DroppedMessages() uint64 {
+	return s.dropped.Load()
+}
+
+// writeLoop writes queued messages to the client's connection until the client is stopped,
+// then flushes whatever is still queued.
+func (s *Server) writeLoop(client *Client) {
+	defer close(client.stopped)
+	for {
+		select {
+		case msg := <-client.out:
+			if _, err := client.conn.Write(msg); err != nil {
+				client.conn.Close()
+				return
+			}
+			client.stalledSince.Store(0)
+		case <-client.done:
+			client.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+			for {
+				select {
+				case msg := <-client.out:
+					if _, err := client.conn.Write(msg); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop ends the client's writer after flushing its queue and waits for it to finish.
+func (client *Client) stop() {
+	close(client.done)
+	<-client.stopped
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectStalledClient logs name in over a pipe and stops reading once the
+// welcome line arrives, like a client whose TCP window has filled up.
+func connectStalledClient(t *testing.T, s *Server, wg *sync.WaitGroup, name string) net.Conn {
+	t.Helper()
+	userEnd, serverEnd := net.Pipe()
+	s.sem <- struct{}{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.handleClient(serverEnd)
+	}()
+
+	reader := bufio.NewReader(userEnd)
+	if _, err := reader.ReadString(':'); err != nil {
+		t.Fatal(err)
+	}
+	userEnd.Write([]byte(name + "\n"))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, "Welcome, "+name) {
+			return userEnd
+		}
+	}
+}
+
+func newPolicyServer(t *testing.T, policy SlowPolicy) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.QueueSize = 4
+	cfg.SlowPolicy = policy
+	cfg.SlowTimeout = 50 * time.Millisecond
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	t.Cleanup(func() { close(s.msgChan) })
+	return s
+}
+
+func TestSend_dropOldestKeepsRoomMoving(t *testing.T) {
+	s := newPolicyServer(t, DropOldest)
+
+	var wg sync.WaitGroup
+	stalled := connectStalledClient(t, s, &wg, "sleepy")
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+
+	for i := 0; i < 20; i++ {
+		alice.send(fmt.Sprintf("message %d", i))
+	}
+	bob.waitFor(t, "[alice]:message 19")
+
+	if s.DroppedMessages() == 0 {
+		t.Error("expected messages to the stalled client to be dropped")
+	}
+
+	alice.send("/quit")
+	bob.send("/quit")
+	stalled.Close()
+	wg.Wait()
+}
+
+func TestSend_disconnectSlowClient(t *testing.T) {
+	s := newPolicyServer(t, Disconnect)
+
+	var wg sync.WaitGroup
+	stalled := connectStalledClient(t, s, &wg, "sleepy")
+	defer stalled.Close()
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for i := 0; ; i++ {
+		s.mu.RLock()
+		remaining := len(s.clients)
+		s.mu.RUnlock()
+		if remaining == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stalled client was never disconnected")
+		}
+		alice.send(fmt.Sprintf("message %d", i))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	alice.send("/quit")
+	wg.Wait()
+}
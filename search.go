@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxSearchResults caps how many matches /search returns.
+const maxSearchResults = 20
+
+// searchIndex is an inverted index from lower-cased words to the messages containing them.
+// It holds the same messages as the room history, which removes them as it trims.
+type searchIndex struct {
+	mu       sync.RWMutex
+	next     int              // position given to the next message added
+	messages map[int]Message  // indexed messages by the position they were added at
+	ids      map[string]int   // message ID -> position, for removing messages
+	postings map[string][]int // word -> ascending positions in messages
+}
+
+// newSearchIndex creates an empty index.
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		messages: make(map[int]Message),
+		ids:      make(map[string]int),
+		postings: make(map[string][]int),
+	}
+}
+
+// tokenize splits text into lower-cased words, treating anything that is not a
+// letter or digit as a separator, so "example.com/page" yields "example", "com" and "page".
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes msg.
+func (ix *searchIndex) add(msg Message) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	pos := ix.next
+	ix.next++
+	ix.messages[pos] = msg
+	if msg.id != "" {
+		ix.ids[msg.id] = pos
+	}
+	seen := make(map[string]bool)
+	for _, word := range tokenize(string(msg.content)) {
+		if !seen[word] {
+			seen[word] = true
+			ix.postings[word] = append(ix.postings[word], pos)
+		}
+	}
+}
+
+// remove drops msgs from the index, matching them by ID.
+func (ix *searchIndex) remove(msgs []Message) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, msg := range msgs {
+		pos, ok := ix.ids[msg.id]
+		if !ok {
+			continue
+		}
+		delete(ix.ids, msg.id)
+		delete(ix.messages, pos)
+		for _, word := range tokenize(string(msg.content)) {
+			list := ix.postings[word]
+			i := sort.SearchInts(list, pos)
+			if i == len(list) || list[i] != pos {
+				continue // a repeated word, already removed
+			}
+			if len(list) == 1 {
+				delete(ix.postings, word)
+				continue
+			}
+			ix.postings[word] = append(list[:i], list[i+1:]...)
+		}
+	}
+}
+
+// searchQuery holds the parsed arguments of a /search command.
+type searchQuery struct {
+	words []string
+	from  string // sender filter, empty for anyone
+	room  string // room filter, empty for every room
+	// hidden lists rooms whose messages are left out of a search of every room
+	hidden map[string]bool
+	since  time.Time // messages before this have expired; zero for no limit
+}
+
+// parseSearchArgs parses "/search <terms> [from:user] [room:name]".
+func parseSearchArgs(args []string) (searchQuery, error) {
+	var q searchQuery
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "from:"):
+			q.from = strings.TrimPrefix(arg, "from:")
+		case strings.HasPrefix(arg, "room:"):
+			q.room = strings.TrimPrefix(arg, "room:")
+		default:
+			q.words = append(q.words, tokenize(arg)...)
+		}
+	}
+	if len(q.words) == 0 {
+		return q, fmt.Errorf("give at least one word to search for")
+	}
+	return q, nil
+}
+
+// search returns up to limit of the newest messages containing every query word
+// and passing the sender and room filters, oldest first.
+func (ix *searchIndex) search(q searchQuery, limit int) []Message {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	// intersect starting from the rarest word
+	lists := make([][]int, 0, len(q.words))
+	for _, word := range q.words {
+		list, ok := ix.postings[word]
+		if !ok {
+			return nil
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	matches := lists[0]
+	for _, list := range lists[1:] {
+		matches = intersect(matches, list)
+	}
+
+	var found []Message
+	for i := len(matches) - 1; i >= 0 && len(found) < limit; i-- {
+		msg := ix.messages[matches[i]]
+		if q.from != "" && !strings.EqualFold(msg.sender, q.from) {
+			continue
+		}
+		if q.room != "" && msg.room != q.room || q.hidden[msg.room] || msg.msgDate.Before(q.since) {
+			continue
+		}
+		found = append(found, msg)
+	}
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
+// intersect returns the positions present in both ascending lists.
+func intersect(a, b []int) []int {
+	var out []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// searchHistory answers a /search command. Without a room: filter it searches
+// every room, except those the client could not join.
+func (s *Server) searchHistory(client *Client, args []string) {
+	q, err := parseSearchArgs(args)
+	if err != nil {
+		s.sendError(client, fmt.Sprintf("%v\nUsage: /search <terms> [from:user] [room:name]\n", err))
+		return
+	}
+	s.mu.RLock()
+	var refusal string
+	if q.room != "" {
+		refusal = s.readRefusal(client, q.room)
+	} else {
+		q.hidden = make(map[string]bool)
+		for room := range s.roomInfo {
+			if s.readRefusal(client, room) != "" {
+				q.hidden[room] = true
+			}
+		}
+	}
+	s.mu.RUnlock()
+	if refusal != "" {
+		s.sendError(client, refusal)
+		return
+	}
+	// history not trimmed since it expired is still indexed
+	if age := s.config.HistoryMaxAge; age > 0 {
+		q.since = time.Now().Add(-age)
+	}
+
+	found := s.index.search(q, maxSearchResults)
+	if len(found) == 0 {
+		s.send(client, []byte("No messages found.\n"))
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nFound %d message(s):\n", len(found))
+	for _, msg := range found {
+		if msg.topic {
+			fmt.Fprintf(&b, "[%v][%s]%s", msg.msgDate.Format("2006-01-02 15:04:05"), msg.room, topicLine(msg))
+			continue
+		}
+		fmt.Fprintf(&b, "[%v][%s][%s]:%s", msg.msgDate.Format("2006-01-02 15:04:05"), msg.room, msg.sender, msg.content)
+	}
+	b.WriteString("\n")
+	s.send(client, []byte(b.String()))
+}
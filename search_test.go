@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSearchIndex_search(t *testing.T) {
+	ix := newSearchIndex()
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.Local)
+	for i, m := range []struct{ sender, room, text string }{
+		{"alice", "lobby", "check https://example.com/build for the build log\n"},
+		{"bob", "lobby", "the build is green\n"},
+		{"alice", "ops", "build broke again\n"},
+		{"carol", "lobby", "lunch?\n"},
+		{"Bob", "lobby", "example.com is down\n"},
+	} {
+		ix.add(Message{sender: m.sender, room: m.room, content: []byte(m.text), msgDate: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	tests := []struct {
+		name  string
+		args  string
+		limit int
+		want  []string
+	}{
+		{name: "Single word", args: "build", limit: 20, want: []string{"alice", "bob", "alice"}},
+		{name: "All words must match", args: "example.com build", limit: 20, want: []string{"alice"}},
+		{name: "Case insensitive", args: "BUILD room:ops", limit: 20, want: []string{"alice"}},
+		{name: "Filters without words", args: "from:bob", limit: 20, want: nil},
+		{name: "From and room", args: "example from:BOB room:lobby", limit: 20, want: []string{"Bob"}},
+		{name: "Newest first when limited", args: "build", limit: 2, want: []string{"bob", "alice"}},
+		{name: "Unknown word", args: "deploy", limit: 20, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseSearchArgs(strings.Fields(tt.args))
+			if err != nil {
+				if tt.want != nil {
+					t.Fatalf("parseSearchArgs() error = %v", err)
+				}
+				return
+			}
+			var got []string
+			for _, msg := range ix.search(q, tt.limit) {
+				got = append(got, msg.sender)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("search(%q) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchIndex_remove(t *testing.T) {
+	ix := newSearchIndex()
+	msgs := []Message{
+		{id: "1", sender: "alice", room: "lobby", content: []byte("build build broke\n")},
+		{id: "2", sender: "bob", room: "lobby", content: []byte("build fixed\n")},
+	}
+	for _, msg := range msgs {
+		ix.add(msg)
+	}
+	ix.remove(msgs[:1])
+
+	q, _ := parseSearchArgs([]string{"build"})
+	if got := ix.search(q, 20); len(got) != 1 || got[0].id != "2" {
+		t.Errorf("search after remove = %v, want only message 2", got)
+	}
+	if _, ok := ix.postings["broke"]; ok {
+		t.Error("a word only the removed message had is still indexed")
+	}
+	ix.remove(msgs[1:])
+	if len(ix.messages) != 0 || len(ix.ids) != 0 || len(ix.postings) != 0 {
+		t.Errorf("index still holds %d messages, %d IDs and %d words", len(ix.messages), len(ix.ids), len(ix.postings))
+	}
+}
+
+func TestServer_searchForgetsTrimmedHistory(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistoryDir = t.TempDir()
+	cfg.HistoryLimit = 2
+
+	first, _ := NewServerWithConfig(cfg)
+	if err := first.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"oldest news\n", "older news\n", "latest news\n"} {
+		first.recordMessage(Message{id: first.newMessageID(), sender: "alice", content: []byte(text), room: "lobby", msgDate: time.Now()})
+	}
+	q, _ := parseSearchArgs([]string{"news"})
+	if got := first.index.search(q, 20); len(got) != 2 || string(got[0].content) != "older news\n" {
+		t.Errorf("search = %v, want the two messages history kept", got)
+	}
+	first.closeHistory()
+
+	// the store keeps everything, but only what history keeps is indexed on loading
+	second, _ := NewServerWithConfig(cfg)
+	if err := second.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	defer second.closeHistory()
+	if n := len(second.index.messages); n != 2 {
+		t.Errorf("%d messages indexed after loading, want 2", n)
+	}
+}
+
+func TestServer_searchCoversEveryRoom(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.send("deploy at noon")
+	alice.waitFor(t, "[alice]:deploy at noon")
+	alice.send("/join lobby")
+	alice.waitFor(t, "You have joined: lobby")
+
+	alice.send("/search deploy")
+	alice.waitFor(t, "[room1_:0][alice]:deploy at noon")
+	alice.send("/search deploy room:lobby")
+	alice.waitFor(t, "No messages found.")
+
+	alice.send("/quit")
+	wg.Wait()
+}
@@ -3,59 +3,177 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"math/rand"
+	"io"
 	"net"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // Server struct defines the core attributes of the TCP chat server.
 type Server struct {
-	listenAddr  string
-	ln          net.Listener
-	msgChan     chan Message
-	clients     map[net.Conn]string
-	sem         chan struct{}
-	msgStore    []Message
-	shutdown    chan struct{}       // Shutdown channel
-	rooms       map[string][]Client // Map to store clients in rooms
-	clientRooms map[net.Conn]string // track current room of each client
-	tempMsg     string
+	config     Config
+	listenAddr string
+	listeners  []net.Listener
+	msgChan    chan Message
+	sem        chan struct{}
+	tls        *tls.Config                       // TLS settings, nil to accept plain TCP
+	sshConfig  *ssh.ServerConfig                 // SSH settings, nil when SSH is off
+	tlsLoaded  atomic.Pointer[tls.Config]        // the certificates s.tls serves, swapped by reload
+	sshKeys    atomic.Pointer[map[string]string] // names of the SSH keys allowed in, swapped by reload
+	started    time.Time                         // when the server was created, for uptime
+	shutdown   chan struct{}                     // Shutdown channel
+	drained    chan struct{}                     // closed once every session has ended during shutdown
+	sessionWG  sync.WaitGroup                    // running handleClient calls
+	workers    sync.WaitGroup                    // accept loops, the dispatcher and other goroutines shutdown waits for
+	dropped    atomic.Uint64                     // messages discarded for slow clients
+	lastID     atomic.Uint64                     // last message ID handed out
+
+	// these do their own locking
+	names    *nameRegistry // names held by connected clients
+	index    *searchIndex  // every message seen, for /search
+	mailbox  *mailbox      // direct messages waiting for offline users
+	accounts *accountStore // registered names, nil when registration is disabled
+
+	// storeMu serializes writing history to the store, so compacting a room
+	// cannot miss a message being appended; take it before mu
+	storeMu sync.Mutex
+
+	// modesMu serializes saving the modes of private rooms; take it before mu
+	modesMu    sync.Mutex
+	savedModes map[string]RoomModes // what was last saved, to skip saves that change nothing
+
+	// extMu guards slash commands and extension hooks
+	extMu        sync.RWMutex
+	commands     map[string]*command
+	commandOrder []string // command names in registration order, for /help
+	messageHooks []MessageHook
+	joinHooks    []RoomHook
+	leaveHooks   []RoomHook
+
+	// mu guards all room, membership and history state below. Every
+	// connection goroutine and the broadcast goroutine go through it.
+	mu        sync.RWMutex
+	clients   map[net.Conn]*Client  // connected clients keyed by their connection
+	history   map[string][]Message  // recent messages of each room, oldest first
+	store     HistoryStore          // persistent history, nil when history is memory only
+	trimmed   map[string]int        // messages trimmed from each room's history since its store was compacted
+	rooms     map[string][]*Client  // Map to store clients in rooms
+	roomInfo  map[string]*roomState // operators, bans and mutes of each room
+	bannedIPs map[string]bool       // addresses turned away from the whole server
+	sessions  map[net.Conn]*Client  // connections being served, with their client once it exists
+	closing   bool                  // the server is shutting down and takes no new sessions
 }
 
 // Client struct represents a user in the chat.
+// userName and room are only written while holding Server.mu, userName by the
+// client's own goroutine and room also by operators removing the client, so
+// other goroutines must hold Server.mu to read them.
 type Client struct {
-	conn     net.Conn
-	userName string
-	room     string
+	server     *Server
+	conn       net.Conn
+	reader     *bufio.Reader
+	userName   string
+	room       string
+	structured bool          // speaks the JSON lines protocol, fixed before the writer starts
+	account    string        // registered name the client logged in to or registered, if any
+	verifiedBy string        // what proved the client's name, such as "SSH key", if it cannot be changed
+	telnet     *telnetReader // filters the client's input, and knows its terminal width if it uses telnet
+	lastDM     string        // who last sent this client a direct message, for /r
+	quit       bool          // set by /quit, only touched by the client's own goroutine
+
+	// the JSON request being handled, only touched by the client's own goroutine
+	request       string // id the client gave the request, empty if none
+	requestFailed bool   // an error has already answered the request
+
+	out          chan []byte   // outbound queue drained by writeLoop
+	done         chan struct{} // closed when the client is going away
+	stopped      chan struct{} // closed once writeLoop has returned
+	dropped      atomic.Uint64 // messages discarded because the queue was full
+	stalledSince atomic.Int64  // unix nanos when the queue was first found full, 0 if draining
 }
 
 // Message struct represents a message in the chat.
 type Message struct {
+	id      string // unique across restarts, see newMessageID
 	sender  string
 	content []byte
 	conn    net.Conn
+	room    string
 	msgDate time.Time
+	topic   bool // a topic change, with the new topic as content
 }
 
-// NewServer initializes a new instance of the Server.
+// NewServer initializes a new instance of the Server with the default config.
 func NewServer(port string) (*Server, error) {
-	return &Server{
-		listenAddr:  port,
-		msgChan:     make(chan Message, 10),
-		clients:     make(map[net.Conn]string),
-		sem:         make(chan struct{}, 10),
-		msgStore:    make([]Message, 0),
-		shutdown:    make(chan struct{}),       // Initialize the shutdown channel
-		rooms:       make(map[string][]Client), // intialize the rooms map
-		clientRooms: make(map[net.Conn]string),
-		tempMsg: "",
-	}, nil
+	cfg := DefaultConfig()
+	cfg.ListenAddr = port
+	return NewServerWithConfig(cfg)
+}
+
+// NewServerWithConfig initializes a new instance of the Server from cfg.
+func NewServerWithConfig(cfg Config) (*Server, error) {
+	if cfg.QueueSize < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1, got %d", cfg.QueueSize)
+	}
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var accounts *accountStore
+	if cfg.AccountsFile != "" {
+		if accounts, err = loadAccounts(cfg.AccountsFile); err != nil {
+			return nil, err
+		}
+	}
+	s := &Server{
+		config:     cfg,
+		listenAddr: cfg.ListenAddr,
+		msgChan:    make(chan Message, 10),
+		clients:    make(map[net.Conn]*Client),
+		names:      newNameRegistry(),
+		sem:        make(chan struct{}, 10),
+		history:    make(map[string][]Message),
+		trimmed:    make(map[string]int),
+		index:      newSearchIndex(),
+		mailbox:    newMailbox(cfg.MailboxLimit),
+		accounts:   accounts,
+		shutdown:   make(chan struct{}), // Initialize the shutdown channel
+		drained:    make(chan struct{}),
+		sessions:   make(map[net.Conn]*Client),
+		rooms:      make(map[string][]*Client), // intialize the rooms map
+		roomInfo:   make(map[string]*roomState),
+		commands:   make(map[string]*command),
+		bannedIPs:  make(map[string]bool),
+		started:    time.Now(),
+	}
+	if tlsConfig != nil {
+		s.tlsLoaded.Store(tlsConfig)
+		s.tls = s.reloadableTLS()
+	}
+	if s.sshConfig, err = newSSHConfig(cfg, &s.sshKeys); err != nil {
+		return nil, err
+	}
+	s.lastID.Store(uint64(time.Now().UnixNano()))
+	s.registerBuiltins()
+	if err := s.applyExtensions(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
+// logoWidth is how many columns the logo needs; narrower terminals are spared it.
+const logoWidth = 30
+
 // Logo generates an ASCII art logo with color codes.
 func (s *Server) Logo() (string, error) {
 	logo := "\033[34m" + // Start blue background
@@ -80,284 +198,409 @@ func (s *Server) Logo() (string, error) {
 
 // Start begins listening for incoming connections and processing messages.
 func (s *Server) Start(ctx context.Context) error {
-	ln, err := net.Listen("tcp", s.listenAddr)
+	if err := s.loadHistory(); err != nil {
+		return err
+	}
+	defer s.closeHistory()
+
+	listeners, err := s.listenAll()
 	if err != nil {
 		return err
 	}
-	defer ln.Close()
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+
+	s.listeners = listeners
+
+	// everything that accepts connections, closed first on shutdown
+	closers := make([]io.Closer, 0, len(listeners)+2)
+	for _, ln := range listeners {
+		closers = append(closers, ln)
+	}
 
-	s.ln = ln
+	if s.config.HTTPAddr != "" {
+		httpServer, err := s.serveHTTP()
+		if err != nil {
+			return err
+		}
+		defer httpServer.Close()
+		closers = append(closers, httpServer)
+	}
 
-	go func() {
-		for msg := range s.msgChan {
-			s.broadcastToRoom(msg.conn, msg.content)
+	if s.sshConfig != nil {
+		sshListener, err := net.Listen("tcp", s.config.SSHAddr)
+		if err != nil {
+			return err
 		}
-	}()
+		defer sshListener.Close()
+		closers = append(closers, sshListener)
+		s.goWorker(func() { s.serveSSH(sshListener) })
+	}
 
-	go s.handleConnection()
+	s.goWorker(s.dispatchMessages)
+
+	for _, ln := range listeners {
+		s.goWorker(func() { s.handleConnection(ln) })
+	}
 
 	// Listen for shutdown signal from the context
 	<-ctx.Done()
 
 	// Perform shutdown actions
-	close(s.msgChan)
-	s.closeAllConnections()
+	s.drain(closers)
 
 	return nil
 }
 
-// handleConnection accepts incoming client connections.
-func (s *Server) handleConnection() {
+// dispatchMessages delivers queued chat messages to their rooms until msgChan is closed.
+func (s *Server) dispatchMessages() {
+	for msg := range s.msgChan {
+		s.broadcastToRoom(msg)
+	}
+}
+
+// handleConnection accepts incoming client connections on ln.
+func (s *Server) handleConnection(ln net.Listener) {
 	for {
-		conn, err := s.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-s.shutdown:
 				return
 			default:
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				fmt.Printf("Error accepting connection: %v\n", err)
 				continue
 			}
 		}
 
-		// Semaphore to limit connections
-		select {
-		case s.sem <- struct{}{}:
+		if s.admit(conn) {
 			go s.handleClient(conn)
-		default:
-			conn.Write([]byte("Chatroom is at max capacity. Try later...\n"))
-			conn.Close()
 		}
 	}
 }
 
-var UserNames = make(map[string]bool)
+// admit takes one of the limited connection slots for conn, turning it away
+// if the chat is full or its address is banned. handleClient gives the slot back.
+func (s *Server) admit(conn net.Conn) bool {
+	s.mu.RLock()
+	banned := s.bannedIPs[addrIP(conn.RemoteAddr())]
+	s.mu.RUnlock()
+	if banned {
+		refuse(conn, "You are banned from this server.\n")
+		return false
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+		refuse(conn, "Chatroom is at max capacity. Try later...\n")
+		return false
+	}
+}
 
 // handleClient manages communication with a single client.
 func (s *Server) handleClient(conn net.Conn) {
+	if !s.beginSession(conn) {
+		refuse(conn, s.config.ShutdownMessage+"\n")
+		<-s.sem
+		return
+	}
 	defer func() {
-		s.removeClient(conn)
 		conn.Close()
 		<-s.sem
+		s.endSession(conn)
 	}()
 
-	logo, _ := s.Logo()
-	welcomeMessage := fmt.Sprintf("Welcome to TCP-Chat!\n%s\n[ENTER YOUR NAME]: ", logo)
-	conn.Write([]byte(welcomeMessage))
+	if err := handshake(conn); err != nil {
+		fmt.Printf("TLS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		return
+	}
 
-	userName, _ := bufio.NewReader(conn).ReadString('\n')
-	if len(strings.TrimSpace(userName)) < 3 {
-		conn.Write([]byte("Enter a valid name. Disconnecting...\n"))
+	telnet := newTelnetReader(conn)
+	reader := bufio.NewReader(telnet)
+	structured, ok := false, true
+	if _, isSSH := conn.(*sshConn); !isSSH {
+		// SSH sessions are terminals, with no deadline to wait for a handshake under
+		structured, ok = negotiate(conn, reader)
+	}
+	if !ok {
 		return
 	}
 
-	userName = strings.TrimSpace(userName)
-	// check if user name exist, purpose is to ensure each user has a unique username
+	client := s.newClient(conn, reader)
+	client.structured = structured
+	client.telnet = telnet
+	s.mu.Lock()
+	s.sessions[conn] = client
+	closing := s.closing
+	s.mu.Unlock()
+	if closing {
+		return
+	}
+	go s.writeLoop(client)
+	defer func() {
+		s.removeClient(conn)
+		client.stop()
+		if n := client.dropped.Load(); n > 0 {
+			fmt.Printf("%s dropped %d messages\n", conn.RemoteAddr(), n)
+		}
+	}()
 
-	ok := UserNames[userName]
-	if !ok {
-		UserNames[userName] = true
+	if structured {
+		s.sendEvent(client, nil, Event{Type: EventWelcome, Text: "Welcome to TCP-Chat!"})
+	} else if width := client.TerminalWidth(); width > 0 && width < logoWidth {
+		s.send(client, []byte("Welcome to TCP-Chat!\n"))
 	} else {
-		randInt := rand.Intn(10)
-		userName = fmt.Sprintf("%s%d", userName, randInt)
+		logo, _ := s.Logo()
+		s.send(client, []byte(fmt.Sprintf("Welcome to TCP-Chat!\n%s\n", logo)))
 	}
 
-	client := Client{
-		conn:     conn,
-		userName: userName,
-		room:     "room1",
+	userName, account, ok := s.login(client)
+	if !ok {
+		return
 	}
 
+	s.mu.Lock()
+	client.userName = userName
+	client.account = account
+	s.mu.Unlock()
+
 	s.addClient(conn, client)
 
 	// create a new room for the client
 	roomName := fmt.Sprintf("room1_%s", s.listenAddr)
 
-	s.joinRoom(client, roomName)
-
-	conn.Write([]byte(fmt.Sprintf("Welcome, %s!\nUse /help for more options.\n", userName)))
+	s.joinRoom(client, roomName, "")
 
-	for _, msg := range s.msgStore {
-		timestamp := msg.msgDate.Format("2006-01-02 15:04:05")
-		message := fmt.Sprintf("[%v][%s]:%s", timestamp, msg.sender, string(msg.content))
-		_, err := conn.Write([]byte(message))
-		if err != nil {
-			fmt.Println("Error writing to connection:", err)
-		}
-	}
+	s.send(client, []byte(fmt.Sprintf("Welcome, %s!\nUse /help for more options.\n", userName)))
+	s.deliverMail(client)
 
 	s.readConn(client)
 }
 
 // readConn listens for incoming messages from a specific client.
 // It processes and handles messages, such as commands or chat messages, in real time.
-func (s *Server) readConn(client Client) {
-	reader := bufio.NewReader(client.conn)
+func (s *Server) readConn(client *Client) {
 	for {
-		msg, _ := reader.ReadString('\n')
+		msg, err := s.readLine(client)
+		if err != nil {
+			return
+		}
 
 		formatMsg := s.handleUserInput(client, msg)
+		if client.quit {
+			return
+		}
 		if formatMsg == nil {
+			s.acknowledge(client, "")
 			continue
 		}
 
-		message := Message{
-			sender:  client.userName,
-			content: []byte(formatMsg),
-			conn:    client.conn,
-			msgDate: time.Now(),
-		}
-
 		// Store and broadcast the message
 		if len(strings.Trim(msg, " ")) > 1 {
-			s.msgStore = append(s.msgStore, message)
+			s.mu.RLock()
+			message := Message{
+				id:      s.newMessageID(),
+				sender:  client.userName,
+				content: []byte(formatMsg),
+				conn:    client.conn,
+				room:    client.room,
+				msgDate: time.Now(),
+			}
+			s.mu.RUnlock()
+			if message.room == "" {
+				s.sendError(client, "You are not in a room. Use /join [room-name] first.\n")
+				continue
+			}
+			s.mu.RLock()
+			left, muted := s.muteRemaining(client, message.room)
+			s.mu.RUnlock()
+			if muted {
+				s.sendError(client, fmt.Sprintf("You are muted in %s %s.\n", message.room, describeMute(left)))
+				continue
+			}
+			s.recordMessage(message)
 			s.msgChan <- message
+			s.runMessageHooks(client, message.room, strings.TrimRight(msg, "\r\n"))
+			s.acknowledge(client, message.id)
+			continue
 		}
+		s.acknowledge(client, "")
 	}
 }
 
-// handleUserInput processes special commands sent by the client, such as changing names or joining rooms.
-// It returns the processed message or nil if the input is a command.
-func (s *Server) handleUserInput(client Client, msg string) []byte {
-	switch {
-	case strings.Contains(msg, "/name"):
-		if len(strings.Fields(msg)) < 2 {
-			message := []byte("Enter new name after /name\n")
-			s.clientInfomer(client.conn, message, false)
-			return nil
-		}
-		newUserName := strings.Fields(msg)[1]
-		oldUserName := client.userName
-		client.userName = newUserName
-		s.clients[client.conn] = client.userName
-		message := []byte(fmt.Sprintf("%s is now %s\n", oldUserName, newUserName))
-		s.clientInfomer(client.conn, []byte(message), true)
-
-		// Confirm the name change to the client who requested it
-		confirmation := fmt.Sprintf("\nSuccess! You are now %s\n\n", newUserName)
-		s.clientInfomer(client.conn, []byte(confirmation), false)
-		return nil
-
-	case strings.Contains(msg, "/users"):
-		message := "\nBuddies currently in the chat:\n"
-		for user := range s.clients {
-			message += fmt.Sprintf("%s\n", s.clients[user])
-		}
-		s.clientInfomer(client.conn, []byte(message), false)
-		return nil
-
-	case strings.Contains(msg, "/help"):
-		message := "\nAvailable commands:\n/name [new-name]: Change your name\n/users: See who's in the chat\n/help: Display this log of available commands\n/quit: Leave the chat\n/join [room-name]: Join a specific room\n/leave: Leave your current room\n/rooms: List all available rooms\n/rooms [room-name]: List members in a specific room\n\n"
-		s.clientInfomer(client.conn, []byte(message), false)
-		return nil
-
-	case strings.Contains(msg, "/quit"):
-		message := "\nExiting the chat..."
-		s.clientInfomer(client.conn, []byte(message), false)
-		s.leaveRoom(client.conn)
-		client.conn.Close()
+// handleUserInput runs the command on msg if it is one.
+// It returns the message to broadcast, or nil if the input was a command.
+func (s *Server) handleUserInput(client *Client, msg string) []byte {
+	if s.dispatchCommand(client, msg) {
 		return nil
-
-	case strings.HasPrefix(msg, "/join"):
-		msgs := strings.Fields(msg)
-		if len(msgs) > 1 {
-			roomName := strings.TrimSpace(msgs[1])
-			if roomName == "" {
-				s.clientInfomer(client.conn, []byte("Usage: /join [room-name]\n"), false)
-				return nil
-			}
-			s.joinRoom(client, roomName)
-			return nil
-		}
-
-	case strings.Contains(msg, "/leave"):
-		s.leaveRoom(client.conn)
-		return nil
-
-	case strings.Contains(msg, "/rooms"):
-		args := strings.Fields(msg)
-		if len(args) == 1 {
-			s.listRooms(client.conn)
-		} else {
-			room := strings.TrimSpace(args[1])
-			s.listRoomMembers(client.conn, room)
-		}
-
-	default:
-		return []byte(msg)
 	}
+	return []byte(msg)
+}
 
-	return nil
+// listUsers sends the client the names of everyone connected.
+func (s *Server) listUsers(client *Client, args []string) {
+	message := "\nBuddies currently in the chat:\n"
+	s.mu.RLock()
+	for _, c := range s.clients {
+		message += fmt.Sprintf("%s\n", c.userName)
+	}
+	s.mu.RUnlock()
+	s.clientInfomer(client, []byte(message), false)
 }
 
-// leaveRoom removes a client from their current room, notifies other clients, and deletes empty rooms.
-func (s *Server) leaveRoom(conn net.Conn) {
-	currentRoom := s.clientRooms[conn]
+// quit says goodbye to the client and makes readConn stop reading from it.
+func (s *Server) quit(client *Client, args []string) {
+	message := "\nExiting the chat..."
+	s.clientInfomer(client, []byte(message), false)
+	s.leaveRoom(client)
+	client.quit = true
+}
 
-	// get list of clients in the current room
-	clients, roomExists := s.rooms[currentRoom]
+// leaveRoom removes a client from their current room, notifies the rest of the room, and deletes empty rooms.
+func (s *Server) leaveRoom(client *Client) {
+	s.mu.RLock()
+	currentRoom := client.room
+	_, roomExists := s.rooms[currentRoom]
+	userName := client.userName
+	s.mu.RUnlock()
 	if !roomExists {
-		s.clientInfomer(conn, []byte("Room does not exist.\n"), false)
+		s.sendError(client, "Room does not exist.\n")
 		return
 	}
 
-	// find and remove the client from the room's client slice
-	for i, client := range clients {
-		if client.conn == conn {
-			// remove the client from the room slice
-			s.rooms[currentRoom] = append(clients[:i], clients[i+1:]...)
+	if s.removeMember(client, currentRoom) {
+		ev := Event{Type: EventLeave, Room: currentRoom, From: userName}
+
+		// notify the client that they have left the room
+		s.sendEvent(client, []byte(fmt.Sprintf("You have left the room: %s\n", currentRoom)), ev)
 
-			// remove the client from clientRooms mapping
-			delete(s.clientRooms, conn)
+		// notify the rest of the room
+		s.notifyRoom(currentRoom, []byte(fmt.Sprintf("%s has left the room!", userName)), ev)
 
-			// notify the client that they have left the room
-			s.clientInfomer(conn, []byte(fmt.Sprintf("You have left the room: %s\n", currentRoom)), false)
+		s.runLeaveHooks(client, currentRoom)
+	}
+}
 
-			// notify others
-			s.clientInfomer(conn, []byte(fmt.Sprintf("%s has left the room!", s.clients[conn])), true)
+// removeMember takes client out of room, deleting the room once it is empty.
+// It reports false if client was not in room, such as when an operator removed it first.
+func (s *Server) removeMember(client *Client, room string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			break
+	// find and remove the client from the room's client slice
+	clients := s.rooms[room]
+	for i, c := range clients {
+		if c != client {
+			continue
+		}
+		// remove the client from the room slice without touching the
+		// backing array other goroutines may have snapshotted
+		members := make([]*Client, 0, len(clients)-1)
+		members = append(members, clients[:i]...)
+		s.rooms[room] = append(members, clients[i+1:]...)
+		client.room = ""
+		if rs, ok := s.roomInfo[room]; ok {
+			delete(rs.operators, client)
 		}
-	}
 
-	// if the room is now empty, delete it
-	if len(s.rooms[currentRoom]) == 0 {
-		delete(s.rooms, currentRoom)
+		// if the room is now empty, delete it
+		if len(s.rooms[room]) == 0 {
+			delete(s.rooms, room)
+			s.forgetRoom(room)
+		}
+		return true
 	}
+	return false
 }
 
-// broadcastToRoom sends a message to all clients in a specific room except the sender.
-func (s *Server) broadcastToRoom(sender net.Conn, msg []byte) {
-	currentRoom := s.clientRooms[sender]
-	timestamp := TimeFormat()
-	message := fmt.Sprintf("[%v][%s]:%s", timestamp, s.clients[sender], msg)
+// runLeaveHooks calls every leave hook for client leaving room.
+func (s *Server) runLeaveHooks(client *Client, room string) {
+	s.extMu.RLock()
+	hooks := s.leaveHooks
+	s.extMu.RUnlock()
+	s.runRoomHooks(hooks, client, room)
+}
+
+// broadcastToRoom sends a message to all clients in the room it was sent to.
+func (s *Server) broadcastToRoom(msg Message) {
+	s.mu.RLock()
+	members := s.rooms[msg.room]
+	s.mu.RUnlock()
+
+	timestamp := msg.msgDate.Format("2006-01-02 15:04:05")
+	message := fmt.Sprintf("[%v][%s]:%s", timestamp, msg.sender, msg.content)
 	s.Logs(message)
 
-	for _, client := range s.rooms[currentRoom] {
-		if client.conn == sender {
+	ev := Event{Type: EventMessage, ID: msg.id, Room: msg.room, From: msg.sender, Text: strings.TrimRight(string(msg.content), "\r\n"), Time: msg.msgDate}
+	for _, client := range members {
+		if client.conn == msg.conn {
 			clearscreen := "\033[F\033[K"
-			client.conn.Write([]byte(clearscreen))
+			s.sendEvent(client, []byte(clearscreen+message), ev)
+			continue
 		}
 
-		_, err := client.conn.Write([]byte(message))
-		if err != nil {
-			fmt.Println("Error writing to connection:", err)
-		}
+		s.sendEvent(client, []byte(message), ev)
 	}
 }
 
 // joinRoom adds a client to a specific room and notifies other members.
-func (s *Server) joinRoom(client Client, roomName string) {
+// key is what the client gave for a room locked with /mode +k.
+func (s *Server) joinRoom(client *Client, roomName, key string) {
+	// refuse banned or uninvited users before they leave the room they are in
+	s.mu.RLock()
+	inRoom := client.room != ""
+	refusal := s.joinRefusal(client, roomName)
+	if refusal == "" {
+		refusal = s.accessRefusal(client, roomName, key)
+	}
+	s.mu.RUnlock()
+	if refusal != "" {
+		s.sendError(client, refusal)
+		return
+	}
+
 	// leave the current room if the client is in one
-	s.leaveRoom(client.conn)
+	if inRoom {
+		s.leaveRoom(client)
+	}
 
-	// add the client to the new room
+	// add the client to the new room; whoever opens a room runs it
+	s.mu.Lock()
+	if len(s.rooms[roomName]) == 0 && s.roomState(roomName).creator == "" {
+		s.roomState(roomName).creator = client.userName
+	}
+	operator := s.config.Moderation && len(s.rooms[roomName]) == 0
 	s.rooms[roomName] = append(s.rooms[roomName], client)
-	s.clientRooms[client.conn] = roomName
-	s.clientInfomer(client.conn, []byte(fmt.Sprintf("You have joined: %s\n", roomName)), false)
+	client.room = roomName
+	if operator {
+		s.roomState(roomName).operators[client] = true
+	}
+	userName := client.userName
+	s.mu.Unlock()
+
+	ev := Event{Type: EventJoin, Room: roomName, From: userName}
+	s.sendEvent(client, []byte(fmt.Sprintf("You have joined: %s\n", roomName)), ev)
+	s.showTopic(client, roomName)
+	if operator {
+		s.sendEvent(client, []byte(fmt.Sprintf("You are an operator of %s.\n", roomName)), Event{Type: EventOp, Room: roomName, To: userName})
+	}
+	s.replayHistory(client, roomName)
 
 	// notify the other clients in the room
-	s.clientInfomer(client.conn, []byte(fmt.Sprintf("%s has joined the room!\n", client.userName)), true)
+	s.notifyRoomOthers(client, roomName, []byte(fmt.Sprintf("%s has joined the room!\n", userName)), ev)
+
+	s.extMu.RLock()
+	hooks := s.joinHooks
+	s.extMu.RUnlock()
+	s.runRoomHooks(hooks, client, roomName)
 }
 
 // for logging errors to a file, need to see whats happening when program is running
@@ -369,30 +612,55 @@ func Logger(functionName string, lineNumber int, data interface{}) {
 }
 
 // addClient adds a new client to the server's active clients map.
-// It maps the client's network connection to their username.
-func (s *Server) addClient(conn net.Conn, client Client) {
-	s.clients[conn] = client.userName
+// It maps the client's network connection to the client.
+func (s *Server) addClient(conn net.Conn, client *Client) {
+	s.mu.Lock()
+	s.clients[conn] = client
+	s.mu.Unlock()
 }
 
-// clientInfomer sends a message to a specific client or broadcasts it to all clients.
-func (s *Server) clientInfomer(conn net.Conn, msg []byte, broadcast bool) {
+// clientInfomer sends a message to a specific client or broadcasts it to all other clients.
+func (s *Server) clientInfomer(client *Client, msg []byte, broadcast bool) {
 	if broadcast {
-		for client := range s.clients {
-			if client != conn {
-				message := fmt.Sprintf("\r%s\n", msg)
-				s.Logs(message)
-				_, err := client.Write([]byte(message))
-				if err != nil {
-					fmt.Println("Error writing to connection:", err)
-				}
-			}
-		}
+		s.notifyOthers(client, msg, Event{Type: EventInfo, Text: plainText(msg)})
 	} else {
-		_, err := conn.Write(msg)
-		if err != nil {
-			fmt.Println("Error writing to connection:", err)
+		s.send(client, msg)
+	}
+}
+
+// notifyRoomOthers sends ev to every member of room except client.
+func (s *Server) notifyRoomOthers(client *Client, room string, msg []byte, ev Event) {
+	s.mu.RLock()
+	others := make([]*Client, 0, len(s.rooms[room]))
+	for _, c := range s.rooms[room] {
+		if c != client {
+			others = append(others, c)
+		}
+	}
+	s.mu.RUnlock()
+	message := fmt.Sprintf("\r%s\n", msg)
+	s.Logs(message)
+	for _, c := range others {
+		s.sendEvent(c, []byte(message), ev)
+	}
+}
+
+// notifyOthers sends ev to every connected client except client.
+func (s *Server) notifyOthers(client *Client, msg []byte, ev Event) {
+	s.mu.RLock()
+	others := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		if c != client {
+			others = append(others, c)
 		}
 	}
+	s.mu.RUnlock()
+
+	message := fmt.Sprintf("\r%s\n", msg)
+	s.Logs(message)
+	for _, c := range others {
+		s.sendEvent(c, []byte(message), ev)
+	}
 }
 
 // TimeFormat returns the current time formatted as "YYYY-MM-DD HH:MM:SS".
@@ -400,44 +668,77 @@ func TimeFormat() string {
 	return time.Now().Format("2006-01-02 15:04:05")
 }
 
-// removeClient removes a client from the server's active clients map.
+// removeClient removes a client from the server's active clients map and its room.
 // called when a client disconnects or leaves the chat.
 func (s *Server) removeClient(conn net.Conn) {
+	s.mu.RLock()
+	client, ok := s.clients[conn]
+	inRoom := ok && client.room != ""
+	s.mu.RUnlock()
+
+	if inRoom {
+		s.leaveRoom(client)
+	}
+
+	s.mu.Lock()
 	delete(s.clients, conn)
-}
+	if ok {
+		s.forgetInvitations(client)
+	}
+	s.mu.Unlock()
 
-// closeAllConnections closes all active client connections.
-// This is used when the server is shutting down to release resources.
-func (s *Server) closeAllConnections() {
-	for conn := range s.clients {
-		conn.Close() // Close each active client connection
+	if ok {
+		s.saveModes()
+		s.names.release(client.userName)
 	}
-	fmt.Println("All connections closed.")
 }
 
-// listRooms sends a list of all available chat rooms to the specified client.
-func (s *Server) listRooms(conn net.Conn) {
-	var rooms []string
+// listRooms sends a list of all available chat rooms to the specified client,
+// with how many are in each and its topic. Rooms the client could not join are left out.
+func (s *Server) listRooms(client *Client) {
+	s.mu.RLock()
+	rooms := make([]string, 0, len(s.rooms))
 	for room := range s.rooms {
-		rooms = append(rooms, room)
+		if s.readRefusal(client, room) == "" {
+			rooms = append(rooms, room)
+		}
+	}
+	slices.Sort(rooms)
+	var b strings.Builder
+	b.WriteString("available rooms:\n")
+	for _, room := range rooms {
+		fmt.Fprintf(&b, "  %s (%s)", room, plural(len(s.rooms[room]), "user"))
+		if topic := s.topicOf(room).text; topic != "" {
+			fmt.Fprintf(&b, ": %s", topic)
+		}
+		b.WriteString("\n")
 	}
-	conn.Write([]byte(fmt.Sprintf("available rooms: %s\n", strings.Join(rooms, ", "))))
+	s.mu.RUnlock()
+	s.send(client, []byte(b.String()))
 }
 
-// listRoomMembers sends a list of all members in the specified chat room to the client.
-func (s *Server) listRoomMembers(conn net.Conn, room string) {
+// listRoomMembers sends a list of all members in the specified chat room to the client,
+// as long as the client could join it.
+func (s *Server) listRoomMembers(client *Client, room string) {
+	s.mu.RLock()
 	clients, exists := s.rooms[room]
+	refusal := s.readRefusal(client, room)
+	var members []string
+	for _, c := range clients {
+		members = append(members, c.userName)
+	}
+	s.mu.RUnlock()
 
 	if !exists {
-		conn.Write([]byte(fmt.Sprintf("Room %s does not exist.\n", room)))
+		s.send(client, []byte(fmt.Sprintf("Room %s does not exist.\n", room)))
 		return
 	}
-
-	var members []string
-	for _, client := range clients {
-		members = append(members, client.userName)
+	if refusal != "" {
+		s.sendError(client, refusal)
+		return
 	}
-	conn.Write([]byte(fmt.Sprintf("Members in %s: %s\n", room, strings.Join(members, ", "))))
+
+	s.send(client, []byte(fmt.Sprintf("Members in %s: %s\n", room, strings.Join(members, ", "))))
 }
 
 // Check verifies whether the given string consists entirely of numeric characters.
@@ -450,16 +751,19 @@ func Check(arg string) bool {
 	return true
 }
 
-var mu sync.Mutex
+var (
+	mu      sync.Mutex
+	tempMsg string // last line written by Logs, guarded by mu
+)
 
 // Logs appends a log message to a file named "history.log" for record-keeping.
 func (s *Server) Logs(msg string) {
-	if msg == s.tempMsg {
+	mu.Lock()
+	defer mu.Unlock()
+	if msg == tempMsg {
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
 	filename := "history.log"
 	fileDescriptor, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o644)
 	if err != nil {
@@ -468,43 +772,35 @@ func (s *Server) Logs(msg string) {
 	}
 	defer fileDescriptor.Close()
 	fileDescriptor.WriteString(msg)
-	s.tempMsg = msg
+	tempMsg = msg
 }
 
 func main() {
-	var port string
-	args := os.Args
-	if len(args) == 1 {
-		// default port
-		port = ":8989"
-	} else if len(args) == 2 && Check(args[1]) {
-		port = ":" + args[1]
-	} else {
-		fmt.Println("[USAGE]: ./TCPChat $port")
+	cfg, err := ParseArgs(os.Args[1:])
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Println(err)
+		}
+		PrintUsage(os.Stdout)
 		return
 	}
 
-	server, err := NewServer(port)
+	server, err := NewServerWithConfig(cfg)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	fmt.Println("Server running on port: ", port)
+	if len(cfg.Listen) == 0 {
+		fmt.Println("Server running on port: ", cfg.ListenAddr)
+	}
+	for _, spec := range cfg.Listen {
+		fmt.Println("Listening on", spec)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go func() {
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			input := scanner.Text()
-			if input == "exit" {
-				cancel()
-				fmt.Println("\nServer shutting down...")
-				break
-			}
-		}
-	}()
+	go server.runConsole(os.Stdin, os.Stdout, cancel)
 
 	server.Start(ctx)
 }
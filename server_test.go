@@ -2,19 +2,22 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestServer_Logo(t *testing.T) {
 	type fields struct {
 		listenAddr string
-		ln         net.Listener
 		msgChan    chan Message
-		clients    map[net.Conn]string
+		clients    map[net.Conn]*Client
 		sem        chan struct{}
-		msgStore   []Message
+		history    map[string][]Message
 		shutdown   chan struct{}
 	}
 	tests := []struct {
@@ -27,11 +30,10 @@ func TestServer_Logo(t *testing.T) {
 			name: "Valid Logo",
 			fields: fields{
 				listenAddr: ":8080",
-				ln:         nil,
 				msgChan:    make(chan Message),
-				clients:    make(map[net.Conn]string),
+				clients:    make(map[net.Conn]*Client),
 				sem:        make(chan struct{}, 10),
-				msgStore:   []Message{},
+				history:    make(map[string][]Message),
 				shutdown:   make(chan struct{}),
 			},
 			want: "\033[34m" + // Start blue background
@@ -58,11 +60,10 @@ func TestServer_Logo(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Server{
 				listenAddr: tt.fields.listenAddr,
-				ln:         tt.fields.ln,
 				msgChan:    tt.fields.msgChan,
 				clients:    tt.fields.clients,
 				sem:        tt.fields.sem,
-				msgStore:   tt.fields.msgStore,
+				history:    tt.fields.history,
 				shutdown:   tt.fields.shutdown,
 			}
 			got, err := s.Logo()
@@ -80,11 +81,10 @@ func TestServer_Logo(t *testing.T) {
 func TestServer_Start(t *testing.T) {
 	type fields struct {
 		listenAddr string
-		ln         net.Listener
 		msgChan    chan Message
-		clients    map[net.Conn]string
+		clients    map[net.Conn]*Client
 		sem        chan struct{}
-		msgStore   []Message
+		history    map[string][]Message
 		shutdown   chan struct{}
 	}
 	type args struct {
@@ -100,11 +100,10 @@ func TestServer_Start(t *testing.T) {
 			name: "Invalid address",
 			fields: fields{
 				listenAddr: "invalid:address",
-				ln:         nil,
 				msgChan:    make(chan Message),
-				clients:    make(map[net.Conn]string),
+				clients:    make(map[net.Conn]*Client),
 				sem:        make(chan struct{}, 10),
-				msgStore:   []Message{},
+				history:    make(map[string][]Message),
 				shutdown:   make(chan struct{}),
 			},
 			args: args{
@@ -117,11 +116,10 @@ func TestServer_Start(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Server{
 				listenAddr: tt.fields.listenAddr,
-				ln:         tt.fields.ln,
 				msgChan:    tt.fields.msgChan,
 				clients:    tt.fields.clients,
 				sem:        tt.fields.sem,
-				msgStore:   tt.fields.msgStore,
+				history:    tt.fields.history,
 				shutdown:   tt.fields.shutdown,
 			}
 			if err := s.Start(tt.args.ctx); (err != nil) != tt.wantErr {
@@ -134,16 +132,15 @@ func TestServer_Start(t *testing.T) {
 func TestServer_handleUserInput(t *testing.T) {
 	type fields struct {
 		listenAddr string
-		ln         net.Listener
 		msgChan    chan Message
-		clients    map[net.Conn]string
+		clients    map[net.Conn]*Client
 		sem        chan struct{}
-		msgStore   []Message
+		history    map[string][]Message
 		shutdown   chan struct{}
 	}
 	type args struct {
-		conn net.Conn
-		msg  string
+		client *Client
+		msg    string
 	}
 	tests := []struct {
 		name   string
@@ -155,16 +152,15 @@ func TestServer_handleUserInput(t *testing.T) {
 			name: "Valid message",
 			fields: fields{
 				listenAddr: ":8080",
-				ln:         nil,
 				msgChan:    make(chan Message),
-				clients:    make(map[net.Conn]string),
+				clients:    make(map[net.Conn]*Client),
 				sem:        make(chan struct{}, 10),
-				msgStore:   []Message{},
+				history:    make(map[string][]Message),
 				shutdown:   make(chan struct{}),
 			},
 			args: args{
-				conn: &net.IConn{},
-				msg:  "Hello, World!",
+				client: &Client{conn: &net.TCPConn{}},
+				msg:    "Hello, World!\n",
 			},
 			want: []byte("Hello, World!\n"),
 		},
@@ -172,16 +168,15 @@ func TestServer_handleUserInput(t *testing.T) {
 			name: "Empty message",
 			fields: fields{
 				listenAddr: ":8080",
-				ln:         nil,
 				msgChan:    make(chan Message),
-				clients:    make(map[net.Conn]string),
+				clients:    make(map[net.Conn]*Client),
 				sem:        make(chan struct{}, 10),
-				msgStore:   []Message{},
+				history:    make(map[string][]Message),
 				shutdown:   make(chan struct{}),
 			},
 			args: args{
-				conn: &net.IPConn{},
-				msg:  "",
+				client: &Client{conn: &net.IPConn{}},
+				msg:    "\n",
 			},
 			want: []byte("\n"),
 		},
@@ -190,14 +185,13 @@ func TestServer_handleUserInput(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Server{
 				listenAddr: tt.fields.listenAddr,
-				ln:         tt.fields.ln,
 				msgChan:    tt.fields.msgChan,
 				clients:    tt.fields.clients,
 				sem:        tt.fields.sem,
-				msgStore:   tt.fields.msgStore,
+				history:    tt.fields.history,
 				shutdown:   tt.fields.shutdown,
 			}
-			if got := s.handleUserInput(tt.args.conn, tt.args.msg); !reflect.DeepEqual(got, tt.want) {
+			if got := s.handleUserInput(tt.args.client, tt.args.msg); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Server.handleUserInput() = %v, want %v", got, tt.want)
 			}
 		})
@@ -205,40 +199,222 @@ func TestServer_handleUserInput(t *testing.T) {
 }
 
 func TestCheck(t *testing.T) {
-    type args struct {
-        arg string
-    }
-    tests := []struct {
-        name string
-        args args
-        want bool
-    }{
-        {
-            name: "Valid string",
-            args: args{arg: "1234"},
-            want: true,
-        },
-        {
-            name: "String with spaces",
-            args: args{arg: "invalid name"},
-            want: false,
-        },
-        {
-            name: "String with special characters",
-            args: args{arg: "invalid@name"},
-            want: false,
-        },
-        {
-            name: "String with numbers",
-            args: args{arg: "2525"},
-            want: true,
-        },
-    }
-    for _, tt := range tests {
-        t.Run(tt.name, func(t *testing.T) {
-            if got := Check(tt.args.arg); got != tt.want {
-                t.Errorf("Check() = %v, want %v", got, tt.want)
-            }
-        })
-    }
+	type args struct {
+		arg string
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{
+			name: "Valid string",
+			args: args{arg: "1234"},
+			want: true,
+		},
+		{
+			name: "String with spaces",
+			args: args{arg: "invalid name"},
+			want: false,
+		},
+		{
+			name: "String with special characters",
+			args: args{arg: "invalid@name"},
+			want: false,
+		},
+		{
+			name: "String with numbers",
+			args: args{arg: "2525"},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Check(tt.args.arg); got != tt.want {
+				t.Errorf("Check() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testClient is the user end of a net.Pipe whose server end is driven by handleClient.
+type testClient struct {
+	conn net.Conn
+	mu   sync.Mutex
+	out  strings.Builder
+}
+
+// connectTestClient hands a new pipe to s.handleClient and logs in as name.
+// wg is marked done once handleClient returns.
+func connectTestClient(t *testing.T, s *Server, wg *sync.WaitGroup, name string) *testClient {
+	t.Helper()
+	userEnd, serverEnd := net.Pipe()
+	tc := &testClient{conn: userEnd}
+
+	s.sem <- struct{}{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.handleClient(serverEnd)
+	}()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := userEnd.Read(buf)
+			tc.mu.Lock()
+			tc.out.Write(buf[:n])
+			tc.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	tc.send(name)
+	return tc
+}
+
+// send writes a single line to the server.
+func (tc *testClient) send(line string) {
+	tc.conn.Write([]byte(line + "\n"))
+}
+
+// waitFor blocks until the client has received want or fails the test after a timeout.
+func (tc *testClient) waitFor(t *testing.T, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		tc.mu.Lock()
+		got := tc.out.String()
+		tc.mu.Unlock()
+		if strings.Contains(got, want) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %q", want)
+}
+
+func TestServer_concurrentClients(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	var users sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		tc := connectTestClient(t, s, &wg, fmt.Sprintf("user%d", i))
+		users.Add(1)
+		go func(i int, tc *testClient) {
+			defer users.Done()
+			for j := 0; j < 50; j++ {
+				switch (i + j) % 6 {
+				case 0:
+					tc.send(fmt.Sprintf("/join hammer%d", j%3))
+				case 1:
+					tc.send(fmt.Sprintf("hello %d from %d", j, i))
+				case 2:
+					tc.send(fmt.Sprintf("/name user%d_%d", i, j))
+				case 3:
+					tc.send("/leave")
+				case 4:
+					tc.send("/rooms")
+				case 5:
+					tc.send("/users")
+				}
+			}
+			tc.send("/quit")
+		}(i, tc)
+	}
+	users.Wait()
+	wg.Wait()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.clients) != 0 {
+		t.Errorf("clients left after everyone quit: %d", len(s.clients))
+	}
+	if len(s.rooms) != 0 {
+		t.Errorf("rooms left after everyone quit: %v", s.rooms)
+	}
+}
+
+func TestServer_broadcastStaysInRoom(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	carol := connectTestClient(t, s, &wg, "carol")
+	carol.waitFor(t, "Welcome, carol!")
+
+	carol.send("/join elsewhere")
+	carol.waitFor(t, "You have joined: elsewhere")
+
+	alice.send("hi bob")
+	bob.waitFor(t, "[alice]:hi bob")
+	carol.send("over here")
+	carol.waitFor(t, "[carol]:over here")
+
+	bob.mu.Lock()
+	leaked := strings.Contains(bob.out.String(), "over here")
+	bob.mu.Unlock()
+	if leaked {
+		t.Error("bob received a message sent to another room")
+	}
+
+	for _, tc := range []*testClient{alice, bob, carol} {
+		tc.send("/quit")
+	}
+	wg.Wait()
+}
+
+func TestServer_directMessages(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+	carol := connectTestClient(t, s, &wg, "carol")
+	carol.waitFor(t, "Welcome, carol!")
+
+	alice.send("/msg bob are you free? check /users")
+	bob.waitFor(t, "[DM from alice]:\033[0m are you free? check /users")
+	alice.waitFor(t, "[DM to bob]:\033[0m are you free? check /users")
+
+	bob.send("/r yes")
+	alice.waitFor(t, "[DM from bob]:\033[0m yes")
+
+	alice.send("/msg dave hello?")
+	alice.waitFor(t, "dave is not online.")
+
+	carol.send("/r anyone?")
+	carol.waitFor(t, "Nobody has sent you a direct message yet.")
+
+	// a room message afterwards proves the DMs were never broadcast
+	alice.send("done")
+	carol.waitFor(t, "[alice]:done")
+	carol.mu.Lock()
+	leaked := strings.Contains(carol.out.String(), "free?")
+	carol.mu.Unlock()
+	if leaked {
+		t.Error("carol received a direct message meant for bob")
+	}
+	if got := s.roomHistory(fmt.Sprintf("room1_%s", s.listenAddr)); len(got) != 1 {
+		t.Errorf("room history holds %d messages, want only the room message", len(got))
+	}
+
+	for _, tc := range []*testClient{alice, bob, carol} {
+		tc.send("/quit")
+	}
+	wg.Wait()
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"sync"
+	"time"
+)
+
+// beginSession registers conn as being served, so shutdown can say goodbye to
+// it and wait for it. It returns false once the server is shutting down.
+func (s *Server) beginSession(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.sessions[conn] = nil
+	s.sessionWG.Add(1)
+	return true
+}
+
+// endSession forgets conn once handleClient is done with it.
+func (s *Server) endSession(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.sessions, conn)
+	s.mu.Unlock()
+	s.sessionWG.Done()
+}
+
+// goWorker runs fn in a goroutine that shutdown waits for.
+func (s *Server) goWorker(fn func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn()
+	}()
+}
+
+// drain shuts the server down. It stops accepting connections, says goodbye
+// to every client, gives their queued messages until Config.ShutdownTimeout to
+// be written, cuts off whoever is still connected after that, and waits for
+// every goroutine the server started.
+func (s *Server) drain(closers []io.Closer) {
+	close(s.shutdown)
+	for _, c := range closers {
+		c.Close()
+	}
+
+	s.mu.Lock()
+	s.closing = true
+	sessions := maps.Clone(s.sessions)
+	s.mu.Unlock()
+
+	for conn, client := range sessions {
+		if client == nil {
+			// still connecting; the read it is waiting in fails and it gives up
+			conn.SetReadDeadline(time.Now())
+			continue
+		}
+		s.disconnect(client, s.config.ShutdownMessage+"\n")
+	}
+
+	if !waitTimeout(&s.sessionWG, s.config.ShutdownTimeout) {
+		s.mu.RLock()
+		fmt.Printf("Closing %s that did not finish in time\n", plural(len(s.sessions), "connection"))
+		for conn := range s.sessions {
+			if session, ok := conn.(*sshConn); ok {
+				// closing an SSH channel only asks the peer to close it too, so
+				// cut the connection under it for a peer that will not answer
+				session.conn.Close()
+				continue
+			}
+			conn.Close()
+		}
+		s.mu.RUnlock()
+		s.sessionWG.Wait()
+	}
+
+	// nobody is left to send chat messages
+	close(s.drained)
+	close(s.msgChan)
+	s.workers.Wait()
+	fmt.Println("All connections closed.")
+}
+
+// waitTimeout waits for wg, reporting false if it was still waiting after timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
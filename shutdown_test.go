@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dialUnix connects to the Unix socket at path, retrying while the server starts.
+func dialUnix(t *testing.T, path string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_gracefulShutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	socket := filepath.Join(t.TempDir(), "chat.sock")
+	cfg := DefaultConfig()
+	cfg.Listen = []ListenSpec{{Network: "unix", Address: socket}}
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.ShutdownMessage = "Back in five minutes!"
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan error, 1)
+	go func() { started <- s.Start(ctx) }()
+
+	alice := dialUnix(t, socket)
+	aliceR := bufio.NewReader(alice)
+	readUntil(t, alice, aliceR, "[ENTER YOUR NAME]: ")
+	alice.Write([]byte("alice\n"))
+	readUntil(t, alice, aliceR, "Welcome, alice!")
+
+	bot := dialUnix(t, socket)
+	botR := bufio.NewReader(bot)
+	bot.Write([]byte("HELLO json\nbot\n"))
+	readUntil(t, bot, botR, `"type":"join"`)
+
+	// someone who never gets past the name prompt is not waited for
+	lurker := dialUnix(t, socket)
+	readUntil(t, lurker, bufio.NewReader(lurker), "[ENTER YOUR NAME]: ")
+
+	// chat sent just before shutdown still arrives, ahead of the goodbye
+	alice.Write([]byte("last words\n"))
+	readUntil(t, bot, botR, "last words")
+	cancel()
+
+	readUntil(t, alice, aliceR, "Back in five minutes!")
+	readUntil(t, bot, botR, `{"type":"info","text":"Back in five minutes!"`)
+	for _, r := range []*bufio.Reader{aliceR, botR} {
+		if _, err := io.ReadAll(r); err != nil {
+			t.Errorf("reading to the end of the connection: %v", err)
+		}
+	}
+
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Start() = %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Start did not return after the context was cancelled")
+	}
+
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		t.Error("the server still accepts connections after shutting down")
+	}
+
+	// every goroutine the server started is gone once Start returns
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines still running, %d before the server started:\n%s", n, before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestServer_shutdownCutsOffStuckClients(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.ShutdownTimeout = 200 * time.Millisecond
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	// a client that stops reading leaves its writer stuck on the pipe
+	userEnd, serverEnd := net.Pipe()
+	defer userEnd.Close()
+	s.sem <- struct{}{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.handleClient(serverEnd)
+	}()
+	r := bufio.NewReader(userEnd)
+	readUntil(t, userEnd, r, "[ENTER YOUR NAME]: ")
+	userEnd.Write([]byte("stuck\n"))
+	readUntil(t, userEnd, r, "Use /help for more options.\n")
+	alice.send("are you there?")
+	alice.waitFor(t, "[alice]:are you there?")
+
+	start := time.Now()
+	s.drain(nil)
+	if elapsed := time.Since(start); elapsed < cfg.ShutdownTimeout || elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v, want a little over %v", elapsed, cfg.ShutdownTimeout)
+	}
+	alice.waitFor(t, "The server is shutting down. Goodbye!")
+	wg.Wait()
+
+	// nobody new gets in once the server is shutting down
+	late := connectTestClient(t, s, &wg, "late")
+	late.waitFor(t, "The server is shutting down. Goodbye!")
+	wg.Wait()
+	late.mu.Lock()
+	defer late.mu.Unlock()
+	if strings.Contains(late.out.String(), "[ENTER YOUR NAME]") {
+		t.Error("a client was served after shutdown")
+	}
+}
+
+func TestServer_shutdownWithBlockPolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.SlowPolicy = Block
+	cfg.QueueSize = 1
+	cfg.ShutdownTimeout = 200 * time.Millisecond
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	userEnd, serverEnd := net.Pipe()
+	defer userEnd.Close()
+	s.sem <- struct{}{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.handleClient(serverEnd)
+	}()
+	r := bufio.NewReader(userEnd)
+	readUntil(t, userEnd, r, "[ENTER YOUR NAME]: ")
+	userEnd.Write([]byte("stuck\n"))
+	readUntil(t, userEnd, r, "Use /help for more options.\n")
+
+	// stuck stops reading until its queue is full and the goodbye has no room
+	stuck := s.findClient("stuck")
+	for i := 0; len(stuck.out) < cap(stuck.out); i++ {
+		if i > 200 {
+			t.Fatal("stuck's queue never filled up")
+		}
+		alice.send("are you there?")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	s.drain(nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v, want a little over %v", elapsed, cfg.ShutdownTimeout)
+	}
+	wg.Wait()
+}
+
+// stallingConn stops reading once stalled is set, like a peer that has hung,
+// and discards whatever arrives after that until it is closed.
+type stallingConn struct {
+	net.Conn
+	stalled atomic.Bool
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *stallingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.stalled.Load() {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *stallingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestServer_shutdownCutsOffStuckSSHSessions(t *testing.T) {
+	alice := newTestSigner(t)
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.SSHAddr = "127.0.0.1:0"
+	cfg.SSHHostKey = filepath.Join(dir, "host_key")
+	cfg.SSHAuthorizedKeys = filepath.Join(dir, "keys")
+	cfg.ShutdownTimeout = 200 * time.Millisecond
+	os.WriteFile(cfg.SSHAuthorizedKeys, []byte(authorizedKeyLine(alice, "alice")), 0o600)
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatchMessages()
+	ln, err := net.Listen("tcp", cfg.SSHAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.serveSSH(ln)
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &stallingConn{Conn: raw, closed: make(chan struct{})}
+	defer conn.Close()
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, ln.Addr().String(), &ssh.ClientConfig{
+		User:            "whoever",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(alice)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("ssh login: %v", err)
+	}
+	client := ssh.NewClient(clientConn, channels, requests)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out lockedBuffer
+	session.Stdout = &out
+	stdin, _ := session.StdinPipe() // left open, so the server sees no end of input
+	defer stdin.Close()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	out.waitFor(t, "Welcome, alice!")
+
+	// the peer never answers the server closing its session
+	conn.stalled.Store(true)
+	start := time.Now()
+	s.drain(nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v, want a little over %v", elapsed, cfg.ShutdownTimeout)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// sshHandshakeTimeout bounds how long an SSH client may take to authenticate.
+const sshHandshakeTimeout = 30 * time.Second
+
+// loadAuthorizedKeys reads an authorized_keys style file in which the comment
+// after each key is the chat name the key logs in as, as in
+// "ssh-ed25519 AAAAC3Nza... alice". It returns the names keyed by the wire
+// form of each key.
+func loadAuthorizedKeys(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	for lineNo, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, userName, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo+1, err)
+		}
+		if userName == "" {
+			return nil, fmt.Errorf("%s:%d: key has no user name after it", path, lineNo+1)
+		}
+		keys[string(key.Marshal())] = userName
+	}
+	return keys, nil
+}
+
+// loadHostKey reads the server's SSH host key from path, generating and
+// saving a new ed25519 key there if the file does not exist yet.
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "TCPChat host key")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Generated SSH host key %s\n", path)
+	return ssh.NewSignerFromKey(key)
+}
+
+// newSSHConfig builds the SSH server settings from cfg, or returns nil if SSH is not configured.
+// Only keys listed in the authorized keys file may log in. They are stored in
+// keys and looked up there on every login, so they can be swapped while the server runs.
+func newSSHConfig(cfg Config, keys *atomic.Pointer[map[string]string]) (*ssh.ServerConfig, error) {
+	if cfg.SSHAddr == "" {
+		return nil, nil
+	}
+	if cfg.SSHAuthorizedKeys == "" {
+		return nil, fmt.Errorf("SSH needs an authorized keys file")
+	}
+	loaded, err := loadAuthorizedKeys(cfg.SSHAuthorizedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("loading SSH authorized keys: %v", err)
+	}
+	keys.Store(&loaded)
+	hostKey, err := loadHostKey(cfg.SSHHostKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading SSH host key: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			userName, ok := (*keys.Load())[string(key.Marshal())]
+			if !ok {
+				return nil, fmt.Errorf("unknown key for %s", meta.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"chat-user": userName}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	return config, nil
+}
+
+// serveSSH accepts SSH connections on ln until it is closed.
+func (s *Server) serveSSH(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("Error accepting SSH connection: %v\n", err)
+			continue
+		}
+		s.goWorker(func() { s.handleSSH(conn) })
+	}
+}
+
+// handleSSH authenticates an SSH connection and starts a chat for each shell
+// session opened on it.
+func (s *Server) handleSSH(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.sshConfig)
+	if err != nil {
+		fmt.Printf("SSH handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer serverConn.Close()
+	s.goWorker(func() { ssh.DiscardRequests(requests) })
+
+	// the connection outlives its sessions only until shutdown has said goodbye to them
+	done := make(chan struct{})
+	defer close(done)
+	s.goWorker(func() {
+		select {
+		case <-s.drained:
+			serverConn.Close()
+		case <-done:
+		}
+	})
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only shell sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		session := &sshConn{
+			channel:  channel,
+			conn:     serverConn,
+			terminal: term.NewTerminal(channel, ""),
+			userName: serverConn.Permissions.Extensions["chat-user"],
+			local:    serverConn.LocalAddr(),
+			remote:   serverConn.RemoteAddr(),
+		}
+		s.goWorker(func() { s.handleSSHRequests(session, requests) })
+	}
+}
+
+// handleSSHRequests answers the requests of an SSH session, starting the chat
+// when the client asks for a shell.
+func (s *Server) handleSSHRequests(session *sshConn, requests <-chan *ssh.Request) {
+	started := false
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			// string TERM, then uint32 columns and rows
+			if len(req.Payload) >= 4 {
+				if termLen := 4 + int(binary.BigEndian.Uint32(req.Payload)); len(req.Payload) >= termLen+8 {
+					session.resize(req.Payload[termLen:])
+				}
+			}
+			req.Reply(true, nil)
+		case "window-change":
+			session.resize(req.Payload)
+			req.Reply(true, nil)
+		case "shell":
+			req.Reply(!started, nil)
+			if !started {
+				started = true
+				go func() {
+					if s.admit(session) {
+						s.handleClient(session)
+					}
+				}()
+			}
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// sshConn is an SSH shell session seen as a connection. Input goes through a
+// terminal that echoes and edits lines, since SSH clients send raw keystrokes.
+type sshConn struct {
+	channel  ssh.Channel
+	conn     ssh.Conn // the connection the session runs over
+	terminal *term.Terminal
+	userName string // the name the session's key is authorized for
+	local    net.Addr
+	remote   net.Addr
+	width    atomic.Int32 // terminal columns, 0 until the client says
+
+	mu      sync.Mutex
+	pending bytes.Buffer // the rest of the last line read, not yet returned by Read
+}
+
+// resize sets the terminal width and height from the start of payload.
+func (c *sshConn) resize(payload []byte) {
+	if len(payload) < 8 {
+		return
+	}
+	width := int(binary.BigEndian.Uint32(payload))
+	height := int(binary.BigEndian.Uint32(payload[4:]))
+	c.terminal.SetSize(width, height)
+	c.width.Store(int32(width))
+}
+
+// Read returns the lines typed by the user, each ending in "\n".
+func (c *sshConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending.Len() == 0 {
+		line, err := c.terminal.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		c.pending.WriteString(line + "\n")
+	}
+	return c.pending.Read(p)
+}
+
+// Write prints p above the line the user is typing.
+func (c *sshConn) Write(p []byte) (int, error) {
+	return c.terminal.Write(p)
+}
+
+// Close ends the session.
+func (c *sshConn) Close() error {
+	return c.channel.Close()
+}
+
+func (c *sshConn) LocalAddr() net.Addr  { return c.local }
+func (c *sshConn) RemoteAddr() net.Addr { return c.remote }
+
+// SSH channels have no deadlines. Slow and idle sessions are handled by the
+// outbound queue and by the client closing the session.
+func (c *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var _ net.Conn = (*sshConn)(nil)
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// lockedBuffer collects what an SSH session prints.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	out strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.out.Write(p)
+}
+
+func (b *lockedBuffer) waitFor(t *testing.T, want string) string {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		got := b.out.String()
+		b.mu.Unlock()
+		if strings.Contains(got, want) {
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %q", want)
+	return ""
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// authorizedKeyLine returns an authorized keys entry letting signer log in as userName.
+func authorizedKeyLine(signer ssh.Signer, userName string) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " " + userName + "\n"
+}
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+	alice, bob := newTestSigner(t), newTestSigner(t)
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "Keys with names",
+			content: "# chat users\n" + authorizedKeyLine(alice, "alice") + "\n" + authorizedKeyLine(bob, "bob"),
+			want: map[string]string{
+				string(alice.PublicKey().Marshal()): "alice",
+				string(bob.PublicKey().Marshal()):   "bob",
+			},
+		},
+		{name: "Key without a name", content: string(ssh.MarshalAuthorizedKey(alice.PublicKey())), wantErr: true},
+		{name: "Not a key", content: "alice hunter2\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys")
+			os.WriteFile(path, []byte(tt.content), 0o600)
+			got, err := loadAuthorizedKeys(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadAuthorizedKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("loadAuthorizedKeys() = %d keys, want %d", len(got), len(tt.want))
+			}
+			for key, name := range tt.want {
+				if got[key] != name {
+					t.Errorf("key for %s maps to %q", name, got[key])
+				}
+			}
+		})
+	}
+}
+
+func TestServer_ssh(t *testing.T) {
+	alice := newTestSigner(t)
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.SSHAddr = "127.0.0.1:0"
+	cfg.SSHHostKey = filepath.Join(dir, "host_key")
+	cfg.SSHAuthorizedKeys = filepath.Join(dir, "keys")
+	os.WriteFile(cfg.SSHAuthorizedKeys, []byte(authorizedKeyLine(alice, "alice")), 0o600)
+
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cfg.SSHHostKey); err != nil {
+		t.Fatalf("host key was not generated: %v", err)
+	}
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+	ln, err := net.Listen("tcp", cfg.SSHAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.serveSSH(ln)
+
+	var wg sync.WaitGroup
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+			User:            "whoever",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         3 * time.Second,
+		})
+	}
+
+	if client, err := dial(newTestSigner(t)); err == nil {
+		client.Close()
+		t.Error("unknown key was let in")
+	}
+
+	client, err := dial(alice)
+	if err != nil {
+		t.Fatalf("ssh login: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out lockedBuffer
+	session.Stdout = &out
+	stdin, _ := session.StdinPipe()
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := out.waitFor(t, "Welcome, alice!"); strings.Contains(got, "[ENTER YOUR NAME]") {
+		t.Error("SSH user was asked for a name")
+	}
+	bob.waitFor(t, "alice has joined the room!")
+
+	stdin.Write([]byte("hello over ssh\r"))
+	bob.waitFor(t, "[alice]:hello over ssh")
+	bob.send("hi alice")
+	out.waitFor(t, "[bob]:hi alice")
+
+	stdin.Write([]byte("/name mallory\r"))
+	out.waitFor(t, "Your name comes from your SSH key and cannot be changed.")
+
+	stdin.Write([]byte("/quit\r"))
+	bob.waitFor(t, "alice has left the room!")
+	bob.send("/quit")
+	wg.Wait()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryStore persists room messages so history survives server restarts.
+type HistoryStore interface {
+	// Append durably records msg.
+	Append(msg Message) error
+	// Load returns every stored message, oldest first.
+	Load() ([]Message, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// HistoryCompactor is implemented by a HistoryStore that can drop the messages
+// history no longer keeps, so it does not grow forever.
+type HistoryCompactor interface {
+	// Compact replaces everything stored for room with msgs, oldest first.
+	Compact(room string, msgs []Message) error
+}
+
+// RoomModeStore is implemented by a HistoryStore that also keeps the modes of
+// private rooms, so a locked or invite-only room stays private after a restart
+// along with its history.
+type RoomModeStore interface {
+	// SaveModes durably replaces the stored modes with modes, keyed by room.
+	SaveModes(modes map[string]RoomModes) error
+	// LoadModes returns the stored modes, keyed by room.
+	LoadModes() (map[string]RoomModes, error)
+}
+
+// RoomModes are the modes of a private room, as kept by a RoomModeStore.
+type RoomModes struct {
+	Creator    string   `json:"creator,omitempty"`
+	Key        string   `json:"key,omitempty"`
+	InviteOnly bool     `json:"invite_only,omitempty"`
+	Invited    []string `json:"invited,omitempty"`
+}
+
+// storedMessage is the on-disk form of a Message.
+type storedMessage struct {
+	ID     string    `json:"id,omitempty"`
+	Room   string    `json:"room"`
+	Sender string    `json:"sender"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+	Topic  bool      `json:"topic,omitempty"` // the message is a topic change
+}
+
+// FileHistoryStore is an append-only HistoryStore keeping one JSON lines file per room in a directory.
+type FileHistoryStore struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File // open room files keyed by room name
+}
+
+// OpenFileHistoryStore opens (creating if needed) a FileHistoryStore rooted at dir.
+func OpenFileHistoryStore(dir string) (*FileHistoryStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileHistoryStore{dir: dir, files: make(map[string]*os.File)}, nil
+}
+
+// roomFile returns the path of the file holding room's messages.
+func (fs *FileHistoryStore) roomFile(room string) string {
+	return filepath.Join(fs.dir, url.PathEscape(room)+".jsonl")
+}
+
+// storedLine encodes msg as a line of its room's file.
+func storedLine(msg Message) ([]byte, error) {
+	line, err := json.Marshal(storedMessage{
+		ID:     msg.id,
+		Room:   msg.room,
+		Sender: msg.sender,
+		Text:   string(msg.content),
+		Time:   msg.msgDate,
+		Topic:  msg.topic,
+	})
+	return append(line, '\n'), err
+}
+
+// Append writes msg as a single JSON line to its room's file.
+func (fs *FileHistoryStore) Append(msg Message) error {
+	line, err := storedLine(msg)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fd, ok := fs.files[msg.room]
+	if !ok {
+		fd, err = os.OpenFile(fs.roomFile(msg.room), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		fs.files[msg.room] = fd
+	}
+	_, err = fd.Write(line)
+	return err
+}
+
+// Compact atomically rewrites room's file to hold only msgs, removing it if
+// msgs is empty.
+func (fs *FileHistoryStore) Compact(room string, msgs []Message) error {
+	var data []byte
+	for _, msg := range msgs {
+		line, err := storedLine(msg)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// Append reopens the file once it has been replaced
+	if fd, ok := fs.files[room]; ok {
+		fd.Close()
+		delete(fs.files, room)
+	}
+	if len(msgs) == 0 {
+		if err := os.Remove(fs.roomFile(room)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	tmp, err := os.CreateTemp(fs.dir, ".compact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.roomFile(room))
+}
+
+// Load reads back every room file. Lines that fail to decode, such as one cut
+// short by a crash, are skipped.
+func (fs *FileHistoryStore) Load() ([]Message, error) {
+	paths, err := filepath.Glob(filepath.Join(fs.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []Message
+	for _, path := range paths {
+		roomMsgs, err := readRoomFile(path)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, roomMsgs...)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].msgDate.Before(msgs[j].msgDate)
+	})
+	return msgs, nil
+}
+
+// readRoomFile decodes the messages stored in a single room file.
+func readRoomFile(path string) ([]Message, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var msgs []Message
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var sm storedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &sm); err != nil {
+			fmt.Printf("Skipping corrupt history line in %s: %v\n", path, err)
+			continue
+		}
+		msgs = append(msgs, Message{
+			id:      sm.ID,
+			sender:  sm.Sender,
+			content: []byte(sm.Text),
+			room:    sm.Room,
+			msgDate: sm.Time,
+			topic:   sm.Topic,
+		})
+	}
+	return msgs, scanner.Err()
+}
+
+// modesFile returns the path of the file holding the modes of private rooms.
+// Room files end in .jsonl, so no room's file can clash with it.
+func (fs *FileHistoryStore) modesFile() string {
+	return filepath.Join(fs.dir, "modes.json")
+}
+
+// SaveModes writes modes to the modes file atomically. The file holds room keys,
+// so only its owner may read it.
+func (fs *FileHistoryStore) SaveModes(modes map[string]RoomModes) error {
+	data, err := json.MarshalIndent(modes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(fs.dir, ".modes-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.modesFile())
+}
+
+// LoadModes reads the modes file. A missing file means no room is private.
+func (fs *FileHistoryStore) LoadModes() (map[string]RoomModes, error) {
+	modes := make(map[string]RoomModes)
+	data, err := os.ReadFile(fs.modesFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return modes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &modes); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", fs.modesFile(), err)
+	}
+	return modes, nil
+}
+
+// Close closes all open room files.
+func (fs *FileHistoryStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var firstErr error
+	for room, fd := range fs.files {
+		if err := fd.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(fs.files, room)
+	}
+	return firstErr
+}
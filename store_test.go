@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileHistoryStore_roundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	want := []Message{
+		{id: "m1", sender: "alice", content: []byte("hi\n"), room: "room1_:8989", msgDate: now.Add(-2 * time.Second)},
+		{id: "m2", sender: "bob", content: []byte("odd/room\n"), room: "a/b", msgDate: now.Add(-time.Second)},
+		{id: "m3", sender: "alice", content: []byte("bye\n"), room: "room1_:8989", msgDate: now},
+	}
+	for _, msg := range want {
+		if err := store.Append(msg); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn final line must not prevent the rest of the room from loading
+	fd, err := os.OpenFile(filepath.Join(dir, "room1_:8989.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString(`{"room":"room1_:8989","sen`)
+	fd.Close()
+
+	reopened, err := OpenFileHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	got, err := reopened.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Load() returned %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].id != want[i].id || got[i].sender != want[i].sender || string(got[i].content) != string(want[i].content) ||
+			got[i].room != want[i].room || !got[i].msgDate.Equal(want[i].msgDate) {
+			t.Errorf("message %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestServer_historySurvivesRestart(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistoryDir = t.TempDir()
+
+	first, _ := NewServerWithConfig(cfg)
+	if err := first.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	first.recordMessage(Message{id: first.newMessageID(), sender: "alice", content: []byte("still here?\n"), room: "lobby", msgDate: time.Now()})
+	first.closeHistory()
+
+	second, _ := NewServerWithConfig(cfg)
+	if err := second.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	defer second.closeHistory()
+	got := second.roomHistory("lobby")
+	if len(got) != 1 || string(got[0].content) != "still here?\n" {
+		t.Fatalf("history after restart = %+v", got)
+	}
+	if id := second.newMessageID(); id == got[0].id {
+		t.Errorf("new message reused ID %s from before the restart", id)
+	}
+}
+
+func TestFileHistoryStore_compact(t *testing.T) {
+	store, err := OpenFileHistoryStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	msgs := []Message{
+		{id: "m1", sender: "alice", content: []byte("one\n"), room: "lobby", msgDate: now},
+		{id: "m2", sender: "alice", content: []byte("two\n"), room: "lobby", msgDate: now.Add(time.Second)},
+		{id: "m3", sender: "alice", content: []byte("three\n"), room: "lobby", msgDate: now.Add(2 * time.Second)},
+	}
+	for _, msg := range msgs[:2] {
+		if err := store.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Compact("lobby", msgs[1:2]); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	// appends go to the compacted file
+	if err := store.Append(msgs[2]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].id != "m2" || got[1].id != "m3" {
+		t.Errorf("Load() after Compact() = %+v, want m2 and m3", got)
+	}
+
+	if err := store.Compact("lobby", nil); err != nil {
+		t.Fatalf("Compact() to nothing error = %v", err)
+	}
+	if _, err := os.Stat(store.roomFile("lobby")); !os.IsNotExist(err) {
+		t.Errorf("room file still there after compacting to nothing: %v", err)
+	}
+}
+
+func TestServer_historyFilesStayCompact(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistoryDir = t.TempDir()
+	cfg.HistoryLimit = 3
+
+	first, _ := NewServerWithConfig(cfg)
+	if err := first.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	first.mu.Lock()
+	first.roomState("lobby").topic = roomTopic{text: "standup at 10", setBy: "alice", setAt: now}
+	first.mu.Unlock()
+	first.recordMessage(Message{id: first.newMessageID(), sender: "alice", content: []byte("standup at 10\n"), room: "lobby", msgDate: now, topic: true})
+	for i := 0; i < 20; i++ {
+		first.recordMessage(Message{id: first.newMessageID(), sender: "bob", content: []byte("chatter\n"), room: "lobby", msgDate: now.Add(time.Duration(i+1) * time.Millisecond)})
+	}
+	first.closeHistory()
+
+	stored, err := readRoomFile(filepath.Join(cfg.HistoryDir, "lobby.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) > 2*cfg.HistoryLimit+1 {
+		t.Errorf("room file holds %d messages for a history of %d", len(stored), cfg.HistoryLimit)
+	}
+
+	// the topic outlives the message that set it
+	second, _ := NewServerWithConfig(cfg)
+	if err := second.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	defer second.closeHistory()
+	second.mu.RLock()
+	topic := second.topicOf("lobby")
+	second.mu.RUnlock()
+	if topic.text != "standup at 10" {
+		t.Errorf("topic after compacting and restarting = %+v", topic)
+	}
+	if got := second.roomHistory("lobby"); len(got) != cfg.HistoryLimit {
+		t.Errorf("history after restart has %d messages, want %d", len(got), cfg.HistoryLimit)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Telnet protocol bytes (RFC 854) and the options the server knows about.
+const (
+	telnetSE   = 240 // end of subnegotiation
+	telnetSB   = 250 // start of subnegotiation
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255 // interpret as command
+
+	telnetOptNAWS = 31 // negotiate about window size, RFC 1073
+)
+
+// maxSubnegotiation bounds how much of a subnegotiation is kept; NAWS needs 5 bytes.
+const maxSubnegotiation = 64
+
+// Telnet parser states.
+const (
+	telnetData       = iota // ordinary text
+	telnetCommand           // after IAC
+	telnetOption            // after IAC WILL, WONT, DO or DONT
+	telnetSub               // inside IAC SB ... IAC SE
+	telnetSubCommand        // after IAC inside a subnegotiation
+)
+
+// telnetReader reads text from a connection, taking out telnet commands and
+// turning CRLF, CR NUL and lone CR line endings into "\n", so telnet and nc users
+// both send plain lines. Once the client shows it speaks telnet, the server
+// asks for its window size. Replies are written back on the connection.
+type telnetReader struct {
+	conn io.ReadWriter
+	buf  []byte
+
+	state   int
+	command byte   // the WILL, WONT, DO or DONT being read
+	sub     []byte // the subnegotiation being read
+	lastCR  bool   // the previous text byte was a carriage return
+	replied [256]bool
+
+	telnet atomic.Bool  // the client has sent a telnet command
+	width  atomic.Int32 // terminal columns reported with NAWS, 0 if unknown
+}
+
+func newTelnetReader(conn io.ReadWriter) *telnetReader {
+	return &telnetReader{conn: conn, buf: make([]byte, 4096)}
+}
+
+// Read returns the next text from the connection. It only returns with no
+// text on an error, since bufio.Reader treats repeated empty reads as a fault.
+func (t *telnetReader) Read(p []byte) (int, error) {
+	for {
+		max := len(p)
+		if max > len(t.buf) {
+			max = len(t.buf)
+		}
+		n, err := t.conn.Read(t.buf[:max])
+		out := t.filter(t.buf[:n], p)
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+// filter copies the text in data to p, acting on any telnet commands, and returns how much it copied.
+// p must be at least as long as data.
+func (t *telnetReader) filter(data, p []byte) int {
+	out := 0
+	for _, b := range data {
+		switch t.state {
+		case telnetData:
+			switch {
+			case b == telnetIAC:
+				t.state = telnetCommand
+			case b == '\r':
+				p[out] = '\n'
+				out++
+			case (b == '\n' || b == 0) && t.lastCR:
+				// second half of CRLF or CR NUL
+			default:
+				p[out] = b
+				out++
+			}
+			t.lastCR = b == '\r'
+
+		case telnetCommand:
+			t.state = telnetData
+			switch b {
+			case telnetIAC: // escaped 255 data byte
+				p[out] = b
+				out++
+				continue
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.command = b
+				t.state = telnetOption
+			case telnetSB:
+				t.sub = t.sub[:0]
+				t.state = telnetSub
+			}
+			t.detected()
+
+		case telnetOption:
+			t.negotiate(t.command, b)
+			t.state = telnetData
+
+		case telnetSub:
+			if b == telnetIAC {
+				t.state = telnetSubCommand
+			} else if len(t.sub) < maxSubnegotiation {
+				t.sub = append(t.sub, b)
+			}
+
+		case telnetSubCommand:
+			switch b {
+			case telnetSE:
+				t.subnegotiation(t.sub)
+				t.state = telnetData
+			case telnetIAC:
+				if len(t.sub) < maxSubnegotiation {
+					t.sub = append(t.sub, b)
+				}
+				t.state = telnetSub
+			default:
+				t.state = telnetData
+			}
+		}
+	}
+	return out
+}
+
+// detected notes that the client speaks telnet and asks it for its window size the first time.
+func (t *telnetReader) detected() {
+	if !t.telnet.Swap(true) {
+		t.reply(telnetDO, telnetOptNAWS)
+	}
+}
+
+// negotiate answers the client's offer or request about option. The server
+// accepts window size reports and refuses everything else, answering each
+// option only once so the two sides cannot loop.
+func (t *telnetReader) negotiate(command, option byte) {
+	switch command {
+	case telnetWILL:
+		if option != telnetOptNAWS {
+			t.reply(telnetDONT, option)
+		}
+	case telnetDO:
+		t.reply(telnetWONT, option)
+	}
+}
+
+// subnegotiation handles a completed IAC SB ... IAC SE block.
+func (t *telnetReader) subnegotiation(sub []byte) {
+	if len(sub) >= 5 && sub[0] == telnetOptNAWS {
+		t.width.Store(int32(sub[1])<<8 | int32(sub[2]))
+	}
+}
+
+// reply sends IAC command option, once per option.
+func (t *telnetReader) reply(command, option byte) {
+	if t.replied[option] {
+		return
+	}
+	t.replied[option] = true
+	t.conn.Write([]byte{telnetIAC, command, option})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// chunkedConn returns one chunk per Read and records what is written to it.
+type chunkedConn struct {
+	chunks  [][]byte
+	written bytes.Buffer
+}
+
+func (c *chunkedConn) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks[0] = c.chunks[0][n:]
+	if len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func (c *chunkedConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestTelnetReader(t *testing.T) {
+	const (
+		iac   = "\xff"
+		will  = "\xfb"
+		do    = "\xfd"
+		dont  = "\xfe"
+		wont  = "\xfc"
+		sb    = "\xfa"
+		se    = "\xf0"
+		naws  = "\x1f"
+		echo  = "\x01"
+		ttype = "\x18" // terminal type
+	)
+	tests := []struct {
+		name        string
+		chunks      []string
+		want        string
+		wantReplies string
+		wantWidth   int32
+	}{
+		{name: "Plain nc lines", chunks: []string{"alice\nhello there\n"}, want: "alice\nhello there\n"},
+		{name: "CRLF", chunks: []string{"alice\r\nhi\r\n"}, want: "alice\nhi\n"},
+		{name: "CR NUL and lone CR", chunks: []string{"a\r\x00b\rc\n"}, want: "a\nb\nc\n"},
+		{name: "CRLF split across reads", chunks: []string{"alice\r", "\nhi\r\n"}, want: "alice\nhi\n"},
+		{
+			name:        "Window size negotiation",
+			chunks:      []string{iac + will + naws + iac + sb + naws + "\x00\x50\x00\x18" + iac + se + "alice\r\n"},
+			want:        "alice\n",
+			wantReplies: iac + do + naws,
+			wantWidth:   80,
+		},
+		{
+			name:        "Subnegotiation split across reads",
+			chunks:      []string{iac, sb + naws + "\x00", "\x64\x00\x18" + iac, se + "hi\r", "\n"},
+			want:        "hi\n",
+			wantReplies: iac + do + naws,
+			wantWidth:   100,
+		},
+		{
+			name:        "Escaped IAC in window size",
+			chunks:      []string{iac + sb + naws + "\x00" + iac + iac + "\x00\x18" + iac + se},
+			wantReplies: iac + do + naws,
+			wantWidth:   255,
+		},
+		{
+			name:        "Other options refused once",
+			chunks:      []string{iac + do + echo + iac + will + ttype + iac + do + echo + "x\n"},
+			want:        "x\n",
+			wantReplies: iac + do + naws + iac + wont + echo + iac + dont + ttype,
+		},
+		{name: "Escaped data byte", chunks: []string{"a" + iac + iac + "b\n"}, want: "a\xffb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &chunkedConn{}
+			for _, chunk := range tt.chunks {
+				conn.chunks = append(conn.chunks, []byte(chunk))
+			}
+			tr := newTelnetReader(conn)
+			got, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if conn.written.String() != tt.wantReplies {
+				t.Errorf("replies = %q, want %q", conn.written.String(), tt.wantReplies)
+			}
+			if width := tr.width.Load(); width != tt.wantWidth {
+				t.Errorf("width = %d, want %d", width, tt.wantWidth)
+			}
+			if detected := tr.telnet.Load(); detected != (tt.wantReplies != "") {
+				t.Errorf("telnet detected = %v", detected)
+			}
+		})
+	}
+}
+
+func TestServer_telnetClient(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+
+	// a 20 column telnet terminal offering its size before typing a name
+	alice := connectTestClient(t, s, &wg, "\xff\xfb\x1f\xff\xfa\x1f\x00\x14\x00\x18\xff\xf0alice\r")
+	alice.waitFor(t, "Welcome, alice!")
+	alice.waitFor(t, "\xff\xfd\x1f")
+
+	alice.send("hi bob\r")
+	bob.waitFor(t, "[alice]:hi bob\n")
+	bob.send("/users")
+	bob.waitFor(t, "alice\n")
+
+	alice.mu.Lock()
+	got := alice.out.String()
+	alice.mu.Unlock()
+	if strings.Contains(got, "_nnnn_") {
+		t.Error("logo was sent to a terminal narrower than it")
+	}
+	if strings.Contains(got, "Invalid name") {
+		t.Error("telnet negotiation ended up in the name")
+	}
+
+	alice.send("/quit")
+	bob.send("/quit")
+	wg.Wait()
+}
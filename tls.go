@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a TLS client may take to finish its handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsVersions maps command line spellings to TLS protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a command line value such as "1.2" into a TLS version.
+func ParseTLSVersion(name string) (uint16, error) {
+	if v, ok := tlsVersions[name]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", name)
+}
+
+// loadTLSConfig builds the server's TLS settings from cfg, or returns nil if TLS is not configured.
+func loadTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		if cfg.TLSClientCA != "" {
+			return nil, fmt.Errorf("client certificates need TLS, give a certificate and key too")
+		}
+		return nil, nil
+	}
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, fmt.Errorf("TLS needs both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   cfg.TLSMinVersion,
+	}
+
+	if cfg.TLSClientCA != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("loading client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// reloadableTLS returns a TLS config for listeners that serves whatever
+// s.tlsLoaded holds when each client connects, so certificates can be replaced
+// without reopening the listeners.
+func (s *Server) reloadableTLS() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.tlsLoaded.Load(), nil
+		},
+	}
+}
+
+// handshake completes the TLS handshake of conn, if it is a TLS connection,
+// so a slow handshake is not mistaken for a client that has nothing to say.
+func handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	return tlsConn.Handshake()
+}
+
+// refuse tells conn why it is turned away and closes it. On a TLS connection
+// the write would first run the handshake, which a client that never sends a
+// ClientHello can stall, so there it happens in its own goroutine and under a
+// deadline rather than holding up the accept loop.
+func refuse(conn net.Conn, reason string) {
+	if _, ok := conn.(*tls.Conn); !ok {
+		conn.Write([]byte(reason))
+		conn.Close()
+		return
+	}
+	go func() {
+		defer conn.Close()
+		if handshake(conn) != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(tlsHandshakeTimeout))
+		conn.Write([]byte(reason))
+	}()
+}
+
+// certificateName returns the common name of the verified client certificate
+// conn was opened with, or "" if it has none.
+func certificateName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().VerifiedChains
+	if len(certs) == 0 || len(certs[0]) == 0 {
+		return ""
+	}
+	return certs[0][0].Subject.CommonName
+}
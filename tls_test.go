@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	file string // the CA certificate as a PEM file
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "net-cat test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, pool: pool, file: file}
+}
+
+// issue signs a certificate for commonName, valid for 127.0.0.1, and writes it
+// and its key to PEM files.
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTLSServer(t *testing.T, ca *testCA, minVersion uint16) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.TLSCert, cfg.TLSKey = ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)
+	cfg.TLSMinVersion = minVersion
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestServer_tls(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTestServer(t, newTLSServer(t, ca, tls.VersionTLS12))
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool})
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readUntil(t, conn, r, "[ENTER YOUR NAME]: ")
+	conn.Write([]byte("alice\n"))
+	readUntil(t, conn, r, "Welcome, alice!")
+	conn.Write([]byte("/quit\n"))
+}
+
+func TestServer_tlsRefusals(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTestServer(t, newTLSServer(t, ca, tls.VersionTLS13))
+
+	tests := []struct {
+		name   string
+		config *tls.Config
+	}{
+		{name: "Untrusted CA", config: &tls.Config{RootCAs: newTestCA(t).pool}},
+		{name: "Version below minimum", config: &tls.Config{RootCAs: ca.pool, MaxVersion: tls.VersionTLS12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", addr, tt.config)
+			if err == nil {
+				conn.Close()
+				t.Fatal("TLS dial succeeded, want a handshake error")
+			}
+		})
+	}
+
+	t.Run("Plain TCP", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("alice\n"))
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 4096)
+		n, _ := conn.Read(buf)
+		if strings.Contains(string(buf[:n]), "Welcome") {
+			t.Errorf("plain TCP client was served %q", buf[:n])
+		}
+	})
+}
+
+func TestServer_tlsRefusalDoesNotBlockAccept(t *testing.T) {
+	ca := newTestCA(t)
+	s := newTLSServer(t, ca, tls.VersionTLS12)
+	addr := startTestServer(t, s)
+	s.mu.Lock()
+	s.bannedIPs["127.0.0.1"] = true
+	s.mu.Unlock()
+
+	// a client that never starts the handshake is refused without stalling anyone else
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 3 * time.Second}, "tcp", addr, &tls.Config{RootCAs: ca.pool})
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, bufio.NewReader(conn), "You are banned from this server.")
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    uint16
+		wantErr bool
+	}{
+		{name: "1.2", want: tls.VersionTLS12},
+		{name: "1.3", want: tls.VersionTLS13},
+		{name: "TLS1.3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTLSVersion(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTLSVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTLSVersion() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewServerWithConfig_tlsErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AccountsFile = ""
+	cfg.TLSClientCA = "ca.pem"
+	if _, err := NewServerWithConfig(cfg); err == nil {
+		t.Error("client CA without a server certificate was accepted")
+	}
+	cfg.TLSCert = "cert.pem"
+	if _, err := NewServerWithConfig(cfg); err == nil {
+		t.Error("certificate without a key was accepted")
+	}
+	cfg.TLSKey = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := NewServerWithConfig(cfg); err == nil {
+		t.Error("missing key file was accepted")
+	}
+}
+
+func newMutualTLSServer(t *testing.T, ca *testCA) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.HistoryDir = ""
+	cfg.AccountsFile = ""
+	cfg.TLSCert, cfg.TLSKey = ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)
+	cfg.TLSClientCA = ca.file
+	s, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// dialWithCertificate connects to addr presenting a client certificate for commonName issued by ca.
+func dialWithCertificate(t *testing.T, addr string, serverCA, ca *testCA, commonName string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	certFile, keyFile := ca.issue(t, commonName, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: serverCA.pool, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func TestServer_mutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTestServer(t, newMutualTLSServer(t, ca))
+
+	alice, r := dialWithCertificate(t, addr, ca, ca, "alice")
+	got := readUntil(t, alice, r, "Welcome, alice!")
+	if strings.Contains(got, "[ENTER YOUR NAME]") {
+		t.Error("client with a certificate was asked for a name")
+	}
+
+	alice.Write([]byte("/name mallory\n"))
+	readUntil(t, alice, r, "cannot be changed")
+	alice.Write([]byte("/users\n"))
+	readUntil(t, alice, r, "alice")
+
+	again, r2 := dialWithCertificate(t, addr, ca, ca, "alice")
+	readUntil(t, again, r2, "alice is already in the chat. Disconnecting...")
+
+	invalid, r3 := dialWithCertificate(t, addr, ca, ca, "Alice Smith")
+	readUntil(t, invalid, r3, "is not a valid name")
+
+	alice.Write([]byte("/quit\n"))
+}
+
+func TestServer_mutualTLSRefusals(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTestServer(t, newMutualTLSServer(t, ca))
+
+	tests := []struct {
+		name   string
+		certCA *testCA // who signed the client certificate, nil for none
+	}{
+		{name: "No client certificate"},
+		{name: "Certificate from another CA", certCA: newTestCA(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: ca.pool}
+			if tt.certCA != nil {
+				certFile, keyFile := tt.certCA.issue(t, "mallory", x509.ExtKeyUsageClientAuth)
+				cert, _ := tls.LoadX509KeyPair(certFile, keyFile)
+				config.Certificates = []tls.Certificate{cert}
+			}
+			conn, err := tls.Dial("tcp", addr, config)
+			if err != nil {
+				return // refused during the handshake
+			}
+			defer conn.Close()
+			// with TLS 1.3 the refusal arrives on the first read
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			if err == nil {
+				t.Errorf("client was served %q", buf[:n])
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxTopicLen is the longest topic a room may have, in characters.
+const maxTopicLen = 200
+
+// roomTopic is the topic of a room and who set it.
+type roomTopic struct {
+	text  string
+	setBy string
+	setAt time.Time
+}
+
+// topicOf returns the topic of room, or a zero roomTopic if it has none. The caller must hold s.mu.
+func (s *Server) topicOf(room string) roomTopic {
+	if rs, ok := s.roomInfo[room]; ok {
+		return rs.topic
+	}
+	return roomTopic{}
+}
+
+// topicLine formats msg, a topic change from history, as shown by /history and /search.
+func topicLine(msg Message) string {
+	return fmt.Sprintf("[%s] set the topic to: %s", msg.sender, msg.content)
+}
+
+// topicEvent describes the topic of room for a client.
+func topicEvent(room string, topic roomTopic) Event {
+	return Event{Type: EventTopic, Room: room, From: topic.setBy, Text: topic.text, Time: topic.setAt}
+}
+
+// showTopic tells client the topic of room, if it has one. It is sent on joining.
+func (s *Server) showTopic(client *Client, room string) {
+	s.mu.RLock()
+	topic := s.topicOf(room)
+	s.mu.RUnlock()
+	if topic.text == "" {
+		return
+	}
+	message := fmt.Sprintf("Topic: %s (set by %s on %s)\n", topic.text, topic.setBy, topic.setAt.Format("2006-01-02 15:04"))
+	s.sendEvent(client, []byte(message), topicEvent(room, topic))
+}
+
+// topic handles "/topic [text]", showing the topic of the client's room or
+// changing it. With moderation on, only operators may change it.
+func (s *Server) topic(client *Client, args []string) {
+	s.mu.RLock()
+	room, userName := client.room, client.userName
+	allowed := !s.config.Moderation || s.isOperator(client, room)
+	s.mu.RUnlock()
+	if room == "" {
+		s.sendError(client, "You are not in a room. Use /join [room-name] first.\n")
+		return
+	}
+
+	if len(args) == 0 {
+		s.mu.RLock()
+		hasTopic := s.topicOf(room).text != ""
+		s.mu.RUnlock()
+		if !hasTopic {
+			s.send(client, []byte(fmt.Sprintf("%s has no topic.\n", room)))
+			return
+		}
+		s.showTopic(client, room)
+		return
+	}
+
+	text := strings.TrimSpace(args[0])
+	switch {
+	case !allowed:
+		s.sendError(client, fmt.Sprintf("Only operators of %s can change its topic.\n", room))
+		return
+	case utf8.RuneCountInString(text) > maxTopicLen:
+		s.sendError(client, fmt.Sprintf("Topics are limited to %d characters.\n", maxTopicLen))
+		return
+	}
+
+	msg := Message{
+		id:      s.newMessageID(),
+		sender:  userName,
+		content: []byte(text + "\n"),
+		room:    room,
+		msgDate: time.Now(),
+		topic:   true,
+	}
+	s.mu.Lock()
+	s.roomState(room).topic = roomTopic{text: text, setBy: userName, setAt: msg.msgDate}
+	s.mu.Unlock()
+	s.recordMessage(msg)
+
+	ev := Event{Type: EventTopic, ID: msg.id, Room: room, From: userName, Text: text, Time: msg.msgDate}
+	s.notifyRoom(room, []byte(fmt.Sprintf("%s set the topic of %s to: %s", userName, room, text)), ev)
+}
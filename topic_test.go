@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestServer_topic(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "You are an operator of room1_:0.")
+	bob := connectTestClient(t, s, &wg, "bob")
+	bob.waitFor(t, "Welcome, bob!")
+
+	bob.send("/topic")
+	bob.waitFor(t, "room1_:0 has no topic.")
+	bob.send("/topic free pizza")
+	bob.waitFor(t, "Only operators of room1_:0 can change its topic.")
+
+	alice.send("/topic Incident 42: database failover")
+	bob.waitFor(t, "alice set the topic of room1_:0 to: Incident 42: database failover")
+	bob.send("/topic")
+	bob.waitFor(t, "Topic: Incident 42: database failover (set by alice on ")
+
+	bob.send("/join lobby")
+	bob.waitFor(t, "You have joined: lobby")
+	bob.send("/rooms")
+	bob.waitFor(t, "available rooms:\n  lobby (1 user)\n  room1_:0 (1 user): Incident 42: database failover\n")
+
+	carol := connectTestClient(t, s, &wg, "carol")
+	carol.waitFor(t, "[alice] set the topic to: Incident 42: database failover")
+	carol.waitFor(t, "Topic: Incident 42: database failover (set by alice on ")
+	carol.send("/history")
+	carol.waitFor(t, "[alice] set the topic to: Incident 42: database failover")
+
+	for _, tc := range []*testClient{alice, bob, carol} {
+		tc.send("/quit")
+	}
+	wg.Wait()
+}
+
+func TestServer_topicSurvivesRestart(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.HistoryDir = t.TempDir()
+
+	first, _ := NewServerWithConfig(cfg)
+	if err := first.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	go first.dispatchMessages()
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, first, &wg, "alice")
+	alice.waitFor(t, "You are an operator of room1_:0.")
+	alice.send("/topic old news")
+	alice.waitFor(t, "alice set the topic of room1_:0 to: old news")
+	alice.send("/topic deploy freeze until Monday")
+	alice.waitFor(t, "alice set the topic of room1_:0 to: deploy freeze until Monday")
+	alice.send("/quit")
+	wg.Wait()
+	close(first.msgChan)
+	first.closeHistory()
+
+	second, _ := NewServerWithConfig(cfg)
+	if err := second.loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	defer second.closeHistory()
+	second.mu.RLock()
+	topic := second.topicOf("room1_:0")
+	second.mu.RUnlock()
+	if topic.text != "deploy freeze until Monday" || topic.setBy != "alice" {
+		t.Errorf("topic after restart = %+v", topic)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// webFiles holds the browser chat page served next to the WebSocket endpoint.
+//
+//go:embed web
+var webFiles embed.FS
+
+// webSocketConn is a browser connection. It reports the browser's address
+// rather than the page origin that websocket.Conn gives as its remote address.
+type webSocketConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the address the browser connected from.
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// httpHandler serves the browser chat page at "/" and bridges WebSocket
+// connections on "/ws" into the chat, each one treated like any other client.
+func (s *Server) httpHandler() http.Handler {
+	page, _ := fs.Sub(webFiles, "web")
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(page)))
+	mux.Handle("/ws", websocket.Server{
+		Handshake: sameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			var remote net.Addr = ws.RemoteAddr()
+			if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+				remote = addr
+			}
+			conn := &webSocketConn{Conn: ws, remote: remote}
+			// the connection closes when this handler returns, so serve it here
+			if s.admit(conn) {
+				s.handleClient(conn)
+			}
+		},
+	})
+	return mux
+}
+
+// sameOrigin refuses WebSocket handshakes from pages served by other sites, so
+// a page the user happens to have open elsewhere cannot chat in their name.
+func sameOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || !strings.EqualFold(origin.Host, req.Host) {
+		return fmt.Errorf("origin %v does not match host %s", origin, req.Host)
+	}
+	config.Origin = origin
+	return nil
+}
+
+// serveHTTP starts the web gateway on the configured HTTP address.
+func (s *Server) serveHTTP() (*http.Server, error) {
+	ln, err := net.Listen("tcp", s.config.HTTPAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: s.httpHandler()}
+	s.goWorker(func() { srv.Serve(ln) })
+	return srv, nil
+}
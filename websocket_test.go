@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestServer_webPage(t *testing.T) {
+	s, _ := NewServer(":0")
+	web := httptest.NewServer(s.httpHandler())
+	defer web.Close()
+
+	resp, err := http.Get(web.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `new WebSocket(`) {
+		t.Errorf("GET / = %d %q, want the chat page", resp.StatusCode, body)
+	}
+}
+
+func TestServer_webSocket(t *testing.T) {
+	s, _ := NewServer(":0")
+	go s.dispatchMessages()
+	defer close(s.msgChan)
+	web := httptest.NewServer(s.httpHandler())
+	defer web.Close()
+
+	var wg sync.WaitGroup
+	alice := connectTestClient(t, s, &wg, "alice")
+	alice.waitFor(t, "Welcome, alice!")
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(web.URL, "http")+"/ws", "", web.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	events := bufio.NewScanner(ws)
+	next := func(want func(Event) bool) Event {
+		t.Helper()
+		for events.Scan() {
+			var ev Event
+			if err := json.Unmarshal(events.Bytes(), &ev); err != nil {
+				t.Fatalf("browser received a non-JSON line %q", events.Text())
+			}
+			if want(ev) {
+				return ev
+			}
+		}
+		t.Fatalf("waiting for event: %v", events.Err())
+		return Event{}
+	}
+
+	ws.Write([]byte(jsonHandshake + "\n"))
+	next(func(ev Event) bool { return ev.Type == EventPrompt && ev.Field == "name" })
+	ws.Write([]byte(`{"text":"browser"}` + "\n"))
+	next(func(ev Event) bool { return ev.Type == EventJoin && ev.From == "browser" })
+	alice.waitFor(t, "browser has joined the room!")
+
+	ws.Write([]byte(`{"id":"1","text":"hi from the web"}` + "\n"))
+	alice.waitFor(t, "[browser]:hi from the web")
+	alice.send("hello browser")
+	next(func(ev Event) bool {
+		return ev.Type == EventMessage && ev.From == "alice" && ev.Text == "hello browser"
+	})
+
+	alice.send("/users")
+	alice.waitFor(t, "browser\n")
+
+	ws.Write([]byte(`{"cmd":"quit"}` + "\n"))
+	alice.waitFor(t, "browser has left the room!")
+	alice.send("/quit")
+	wg.Wait()
+}
+
+func TestServer_webSocketRefusesOtherOrigins(t *testing.T) {
+	s, _ := NewServer(":0")
+	web := httptest.NewServer(s.httpHandler())
+	defer web.Close()
+
+	if ws, err := websocket.Dial("ws"+strings.TrimPrefix(web.URL, "http")+"/ws", "", "http://evil.example"); err == nil {
+		ws.Close()
+		t.Error("a page from another site opened a WebSocket")
+	}
+}